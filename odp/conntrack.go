@@ -0,0 +1,315 @@
+package odp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// OVS_ACTION_ATTR_CT: Send the packet through the connection tracker
+
+// ConntrackNat describes the OVS_CT_ATTR_NAT part of a conntrack
+// action.  If neither Src nor Dst is set, the action only applies
+// the NAT that was already set up for the connection.
+type ConntrackNat struct {
+	Src         bool
+	Dst         bool
+	Persistent  bool
+	ProtoHash   bool
+	ProtoRandom bool
+
+	// Address range; nil if absent.  These hold either 4 or 16
+	// bytes, depending on the address family.
+	IpMin []byte
+	IpMax []byte
+
+	// Transport port range, in host byte order
+	ProtoMin        uint16
+	ProtoMax        uint16
+	ProtoMinPresent bool
+	ProtoMaxPresent bool
+}
+
+func (nat ConntrackNat) toNlAttrs(msg *NlMsgBuilder) {
+	if nat.Src {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_SRC)
+	}
+
+	if nat.Dst {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_DST)
+	}
+
+	if nat.IpMin != nil {
+		msg.PutSliceAttr(OVS_NAT_ATTR_IP_MIN, nat.IpMin)
+	}
+
+	if nat.IpMax != nil {
+		msg.PutSliceAttr(OVS_NAT_ATTR_IP_MAX, nat.IpMax)
+	}
+
+	if nat.ProtoMinPresent {
+		msg.PutUint16Attr(OVS_NAT_ATTR_PROTO_MIN, nat.ProtoMin)
+	}
+
+	if nat.ProtoMaxPresent {
+		msg.PutUint16Attr(OVS_NAT_ATTR_PROTO_MAX, nat.ProtoMax)
+	}
+
+	if nat.Persistent {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PERSISTENT)
+	}
+
+	if nat.ProtoHash {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PROTO_HASH)
+	}
+
+	if nat.ProtoRandom {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PROTO_RANDOM)
+	}
+}
+
+func (a ConntrackNat) Equals(b ConntrackNat) bool {
+	return a.Src == b.Src && a.Dst == b.Dst &&
+		a.Persistent == b.Persistent &&
+		a.ProtoHash == b.ProtoHash &&
+		a.ProtoRandom == b.ProtoRandom &&
+		bytes.Equal(a.IpMin, b.IpMin) &&
+		bytes.Equal(a.IpMax, b.IpMax) &&
+		a.ProtoMin == b.ProtoMin && a.ProtoMax == b.ProtoMax &&
+		a.ProtoMinPresent == b.ProtoMinPresent &&
+		a.ProtoMaxPresent == b.ProtoMaxPresent
+}
+
+func parseNatIp(attrs Attrs, typ uint16) ([]byte, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	if len(val) != 4 && len(val) != 16 {
+		return nil, fmt.Errorf("NAT address attribute %d has wrong length (%d bytes)", typ, len(val))
+	}
+
+	return append([]byte(nil), val...), nil
+}
+
+func parseConntrackNat(data []byte) (nat ConntrackNat, err error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return
+	}
+
+	nat.Src, err = attrs.GetEmpty(OVS_NAT_ATTR_SRC)
+	if err != nil {
+		return
+	}
+
+	nat.Dst, err = attrs.GetEmpty(OVS_NAT_ATTR_DST)
+	if err != nil {
+		return
+	}
+
+	nat.IpMin, err = parseNatIp(attrs, OVS_NAT_ATTR_IP_MIN)
+	if err != nil {
+		return
+	}
+
+	nat.IpMax, err = parseNatIp(attrs, OVS_NAT_ATTR_IP_MAX)
+	if err != nil {
+		return
+	}
+
+	nat.ProtoMin, nat.ProtoMinPresent, err = attrs.GetOptionalUint16(OVS_NAT_ATTR_PROTO_MIN)
+	if err != nil {
+		return
+	}
+
+	nat.ProtoMax, nat.ProtoMaxPresent, err = attrs.GetOptionalUint16(OVS_NAT_ATTR_PROTO_MAX)
+	if err != nil {
+		return
+	}
+
+	nat.Persistent, err = attrs.GetEmpty(OVS_NAT_ATTR_PERSISTENT)
+	if err != nil {
+		return
+	}
+
+	nat.ProtoHash, err = attrs.GetEmpty(OVS_NAT_ATTR_PROTO_HASH)
+	if err != nil {
+		return
+	}
+
+	nat.ProtoRandom, err = attrs.GetEmpty(OVS_NAT_ATTR_PROTO_RANDOM)
+	return
+}
+
+type ConntrackAction struct {
+	Commit      bool
+	ForceCommit bool
+
+	Zone        uint16
+	ZonePresent bool
+
+	// Value and mask to set on the connection's mark
+	Mark        uint32
+	MarkMask    uint32
+	MarkPresent bool
+
+	// Value and mask to set on the connection's labels
+	Labels        [OVS_CT_LABELS_LEN]byte
+	LabelsMask    [OVS_CT_LABELS_LEN]byte
+	LabelsPresent bool
+
+	// Name of the connection tracking helper (e.g. "ftp"); empty
+	// if absent
+	Helper string
+
+	// Name of the connection tracking timeout policy; empty if
+	// absent
+	Timeout string
+
+	EventMask        uint32
+	EventMaskPresent bool
+
+	// NAT to apply; nil if absent
+	Nat *ConntrackNat
+}
+
+func (ConntrackAction) typeId() uint16 {
+	return OVS_ACTION_ATTR_CT
+}
+
+func (ct ConntrackAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_CT, func() {
+		if ct.Commit {
+			msg.PutEmptyAttr(OVS_CT_ATTR_COMMIT)
+		}
+
+		if ct.ForceCommit {
+			msg.PutEmptyAttr(OVS_CT_ATTR_FORCE_COMMIT)
+		}
+
+		if ct.ZonePresent {
+			msg.PutUint16Attr(OVS_CT_ATTR_ZONE, ct.Zone)
+		}
+
+		if ct.MarkPresent {
+			mark := make([]byte, 8)
+			*uint32At(mark, 0) = ct.Mark
+			*uint32At(mark, 4) = ct.MarkMask
+			msg.PutSliceAttr(OVS_CT_ATTR_MARK, mark)
+		}
+
+		if ct.LabelsPresent {
+			labels := make([]byte, 0, OVS_CT_LABELS_LEN*2)
+			labels = append(labels, ct.Labels[:]...)
+			labels = append(labels, ct.LabelsMask[:]...)
+			msg.PutSliceAttr(OVS_CT_ATTR_LABELS, labels)
+		}
+
+		if ct.Helper != "" {
+			msg.PutStringAttr(OVS_CT_ATTR_HELPER, ct.Helper)
+		}
+
+		if ct.Timeout != "" {
+			msg.PutStringAttr(OVS_CT_ATTR_TIMEOUT, ct.Timeout)
+		}
+
+		if ct.EventMaskPresent {
+			msg.PutUint32Attr(OVS_CT_ATTR_EVENTMASK, ct.EventMask)
+		}
+
+		if ct.Nat != nil {
+			msg.PutNestedAttrs(OVS_CT_ATTR_NAT, func() {
+				ct.Nat.toNlAttrs(msg)
+			})
+		}
+	})
+}
+
+func (a ConntrackAction) Equals(bx Action) bool {
+	b, ok := bx.(ConntrackAction)
+	if !ok {
+		return false
+	}
+
+	if (a.Nat == nil) != (b.Nat == nil) {
+		return false
+	}
+
+	if a.Nat != nil && !a.Nat.Equals(*b.Nat) {
+		return false
+	}
+
+	a.Nat = nil
+	b.Nat = nil
+	return a == b
+}
+
+func parseConntrackAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ct ConntrackAction
+
+	ct.Commit, err = attrs.GetEmpty(OVS_CT_ATTR_COMMIT)
+	if err != nil {
+		return nil, err
+	}
+
+	ct.ForceCommit, err = attrs.GetEmpty(OVS_CT_ATTR_FORCE_COMMIT)
+	if err != nil {
+		return nil, err
+	}
+
+	ct.Zone, ct.ZonePresent, err = attrs.GetOptionalUint16(OVS_CT_ATTR_ZONE)
+	if err != nil {
+		return nil, err
+	}
+
+	var mark [8]byte
+	ct.MarkPresent, err = attrs.GetOptionalBytes(OVS_CT_ATTR_MARK, mark[:])
+	if err != nil {
+		return nil, err
+	}
+	ct.Mark = *uint32At(mark[:], 0)
+	ct.MarkMask = *uint32At(mark[:], 4)
+
+	var labels [OVS_CT_LABELS_LEN * 2]byte
+	ct.LabelsPresent, err = attrs.GetOptionalBytes(OVS_CT_ATTR_LABELS, labels[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(ct.Labels[:], labels[:OVS_CT_LABELS_LEN])
+	copy(ct.LabelsMask[:], labels[OVS_CT_LABELS_LEN:])
+
+	ct.Helper, _, err = attrs.GetOptionalString(OVS_CT_ATTR_HELPER)
+	if err != nil {
+		return nil, err
+	}
+
+	ct.Timeout, _, err = attrs.GetOptionalString(OVS_CT_ATTR_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	ct.EventMask, ct.EventMaskPresent, err = attrs.GetOptionalUint32(OVS_CT_ATTR_EVENTMASK)
+	if err != nil {
+		return nil, err
+	}
+
+	natattr, err := attrs.Get(OVS_CT_ATTR_NAT, true)
+	if err != nil {
+		return nil, err
+	}
+	if natattr != nil {
+		nat, err := parseConntrackNat(natattr)
+		if err != nil {
+			return nil, err
+		}
+		ct.Nat = &nat
+	}
+
+	return ct, nil
+}
@@ -0,0 +1,151 @@
+package odp
+
+import (
+	"context"
+	"fmt"
+)
+
+// Connection tracking limits bound the number of connections in a
+// conntrack zone.  The kernel keeps them per network namespace
+// rather than per datapath, so they are managed through the Dpif.
+//
+// The zone OVS_ZONE_LIMIT_DEFAULT_ZONE holds the limit applied to
+// zones that have no limit of their own.  A limit of zero means
+// unlimited.
+
+func (dpif *Dpif) newCtLimitRequest(cmd uint8) (*NlMsgBuilder, error) {
+	if err := dpif.checkFamily(CT_LIMIT); err != nil {
+		return nil, err
+	}
+
+	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[CT_LIMIT])
+	req.PutGenlMsghdr(cmd, OVS_CT_LIMIT_VERSION)
+	req.putOvsHeader(0)
+	return req, nil
+}
+
+// The OVS_CT_LIMIT_ATTR_ZONE_LIMIT attribute holds a packed array
+// of ovs_zone_limit structs, rather than nested attributes.
+func (nlmsg *NlMsgBuilder) putZoneLimits(limits []OvsZoneLimit) {
+	nlmsg.PutAttr(OVS_CT_LIMIT_ATTR_ZONE_LIMIT, func() {
+		for _, limit := range limits {
+			pos := nlmsg.Grow(SizeofOvsZoneLimit)
+			*ovsZoneLimitAt(nlmsg.buf, pos) = limit
+		}
+	})
+}
+
+func (dpif *Dpif) ctLimitRequest(ctx context.Context, op string, cmd uint8, limits []OvsZoneLimit) (*NlMsgParser, error) {
+	req, err := dpif.newCtLimitRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits != nil {
+		req.putZoneLimits(limits)
+	}
+
+	resp, err := dpif.request(ctx, op, CT_LIMIT, "", req)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = resp.ExpectNlMsghdr(dpif.familyIds[CT_LIMIT])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = resp.ExpectGenlMsghdr(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = resp.takeOvsHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Set the connection limits for the given zones.  Only the ZoneId
+// and Limit fields are used.
+func (dpif *Dpif) SetConntrackLimits(limits []OvsZoneLimit) error {
+	return dpif.SetConntrackLimitsContext(context.Background(), limits)
+}
+
+func (dpif *Dpif) SetConntrackLimitsContext(ctx context.Context, limits []OvsZoneLimit) error {
+	_, err := dpif.ctLimitRequest(ctx, "set conntrack limits", OVS_CT_LIMIT_CMD_SET, limits)
+	return err
+}
+
+func (dpif *Dpif) SetDefaultConntrackLimit(limit uint32) error {
+	return dpif.SetConntrackLimits([]OvsZoneLimit{{
+		ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE,
+		Limit:  limit,
+	}})
+}
+
+func zoneIdsToLimits(zones []int32) []OvsZoneLimit {
+	limits := make([]OvsZoneLimit, len(zones))
+	for i, zone := range zones {
+		limits[i].ZoneId = zone
+	}
+	return limits
+}
+
+// Remove the connection limits for the given zones, so that they
+// revert to the default limit.  Deleting the default zone's limit
+// makes it unlimited.
+func (dpif *Dpif) DeleteConntrackLimits(zones []int32) error {
+	return dpif.DeleteConntrackLimitsContext(context.Background(), zones)
+}
+
+func (dpif *Dpif) DeleteConntrackLimitsContext(ctx context.Context, zones []int32) error {
+	_, err := dpif.ctLimitRequest(ctx, "delete conntrack limits", OVS_CT_LIMIT_CMD_DEL, zoneIdsToLimits(zones))
+	return err
+}
+
+// Get the connection limits and current connection counts for the
+// given zones.  If zones is nil, the default limit and all zones
+// with limits are returned.
+func (dpif *Dpif) GetConntrackLimits(zones []int32) ([]OvsZoneLimit, error) {
+	return dpif.GetConntrackLimitsContext(context.Background(), zones)
+}
+
+func (dpif *Dpif) GetConntrackLimitsContext(ctx context.Context, zones []int32) ([]OvsZoneLimit, error) {
+	var limits []OvsZoneLimit
+	if zones != nil {
+		limits = zoneIdsToLimits(zones)
+	}
+
+	resp, err := dpif.ctLimitRequest(ctx, "get conntrack limits", OVS_CT_LIMIT_CMD_GET, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := resp.TakeAttrs()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := attrs.Get(OVS_CT_LIMIT_ATTR_ZONE_LIMIT, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseZoneLimits(data)
+}
+
+func parseZoneLimits(data []byte) ([]OvsZoneLimit, error) {
+	if len(data)%SizeofOvsZoneLimit != 0 {
+		return nil, fmt.Errorf("zone limit attribute has wrong length (%d bytes)", len(data))
+	}
+
+	res := make([]OvsZoneLimit, 0, len(data)/SizeofOvsZoneLimit)
+	for pos := 0; pos < len(data); pos += SizeofOvsZoneLimit {
+		res = append(res, *ovsZoneLimitAt(data, pos))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package odp
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Encode zone limits as the OVS_CT_LIMIT_ATTR_ZONE_LIMIT attribute
+// and return its value, without involving the kernel
+func encodeZoneLimits(limits []OvsZoneLimit, t *testing.T) []byte {
+	msg := NewNlMsgBuilder(0, 0)
+	msg.putZoneLimits(limits)
+	data, _ := msg.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := attrs.Get(OVS_CT_LIMIT_ATTR_ZONE_LIMIT, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return val
+}
+
+func TestZoneLimitsRoundTrip(t *testing.T) {
+	for _, limits := range [][]OvsZoneLimit{
+		{},
+		{{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE, Limit: 10}},
+		{
+			{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE, Limit: 10},
+			{ZoneId: 0, Limit: 20, Count: 3},
+			{ZoneId: 65535, Limit: 0, Count: 7},
+		},
+	} {
+		data := encodeZoneLimits(limits, t)
+		if len(data) != len(limits)*SizeofOvsZoneLimit {
+			t.Fatal(len(data))
+		}
+
+		res, err := parseZoneLimits(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, limits) {
+			t.Fatal(res, limits)
+		}
+	}
+}
+
+func TestZoneLimitsTruncated(t *testing.T) {
+	data := encodeZoneLimits([]OvsZoneLimit{
+		{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE, Limit: 10},
+		{ZoneId: 1, Limit: 20},
+	}, t)
+
+	_, err := parseZoneLimits(data[:len(data)-1])
+	if err == nil {
+		t.Fatal("truncated zone limits accepted")
+	}
+}
+
+func TestConntrackLimits(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	// Conntrack limits are global, so this test would disturb
+	// the host
+	if *kernel {
+		t.Skip("not run against the kernel")
+	}
+
+	err = dpif.SetConntrackLimits([]OvsZoneLimit{
+		{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE, Limit: 10},
+		{ZoneId: 1, Limit: 20},
+		{ZoneId: 2, Limit: 30},
+	})
+	if errors.Is(err, ErrNotSupported) {
+		t.Skip("kernel does not support conntrack limits")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer dpif.DeleteConntrackLimits([]int32{OVS_ZONE_LIMIT_DEFAULT_ZONE, 1, 2})
+
+	limits, err := dpif.GetConntrackLimits(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []OvsZoneLimit{
+		{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE, Limit: 10},
+		{ZoneId: 1, Limit: 20},
+		{ZoneId: 2, Limit: 30},
+	}
+	if !reflect.DeepEqual(limits, expect) {
+		t.Fatal(limits)
+	}
+
+	// A deleted zone reverts to the default limit
+	if err := dpif.DeleteConntrackLimits([]int32{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	limits, err = dpif.GetConntrackLimits([]int32{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect = []OvsZoneLimit{{ZoneId: 1, Limit: 10}, {ZoneId: 2, Limit: 30}}
+	if !reflect.DeepEqual(limits, expect) {
+		t.Fatal(limits)
+	}
+}
@@ -1,12 +1,17 @@
 package odp
 
 import (
+	"context"
+	"errors"
 	"syscall"
 )
 
 type datapathInfo struct {
-	ifindex int32
-	name    string
+	ifindex          int32
+	name             string
+	features         uint32
+	masksCacheSize   uint32
+	perCPUUpcallPids []uint32
 }
 
 func (dpif *Dpif) parseDatapathInfo(msg *NlMsgParser) (res datapathInfo, err error) {
@@ -32,44 +37,192 @@ func (dpif *Dpif) parseDatapathInfo(msg *NlMsgParser) (res datapathInfo, err err
 	}
 
 	res.name, err = attrs.GetString(OVS_DP_ATTR_NAME)
+	if err != nil {
+		return
+	}
+
+	res.features, _, err = attrs.GetOptionalUint32(OVS_DP_ATTR_USER_FEATURES)
+	if err != nil {
+		return
+	}
+
+	res.masksCacheSize, _, err = attrs.GetOptionalUint32(OVS_DP_ATTR_MASKS_CACHE_SIZE)
+	if err != nil {
+		return
+	}
+
+	res.perCPUUpcallPids, err = attrs.GetUint32Array(OVS_DP_ATTR_PER_CPU_PIDS, true)
 	return
 }
 
 type DatapathHandle struct {
 	dpif    *Dpif
 	ifindex int32
+
+	// The datapath's name, if known.  Datapaths cannot be
+	// renamed, so it never goes stale.
+	name string
+}
+
+// Reconstruct a handle for the datapath with the given ifindex, e.g.
+// from identifiers persisted by a previous process.  name may be
+// empty if it is not known.  The datapath is not checked to exist;
+// operations on the handle will fail with ErrNoSuchDatapath if
+// it does not.  (Vport operations fail with
+// ErrNoSuchVportOrDatapath, which matches ErrNoSuchDatapath.)
+func (dpif *Dpif) NewDatapathHandle(ifindex int32, name string) DatapathHandle {
+	return DatapathHandle{dpif: dpif, ifindex: ifindex, name: name}
+}
+
+func (dp DatapathHandle) IfIndex() int32 {
+	return dp.ifindex
+}
+
+// The datapath's name, or the empty string if the handle was
+// obtained without learning it (e.g. from VportHandle.Datapath).
+// LookupName queries the kernel in that case.
+func (dp DatapathHandle) Name() string {
+	return dp.name
+}
+
+func (dp DatapathHandle) LookupName() (string, error) {
+	return dp.LookupNameContext(context.Background())
+}
+
+func (dp DatapathHandle) LookupNameContext(ctx context.Context) (string, error) {
+	if dp.name != "" {
+		return dp.name, nil
+	}
+
+	dpi, err := dp.lookupInfo(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return dpi.name, nil
+}
+
+// The user features requested when creating a datapath, unless
+// DatapathOptions says otherwise.
+const DefaultDatapathFeatures = OVS_DP_F_UNALIGNED | OVS_DP_F_VPORT_PIDS
+
+type DatapathOptions struct {
+	// User features (OVS_DP_F_*).  When creating a datapath,
+	// zero means DefaultDatapathFeatures.  When changing a
+	// datapath, zero leaves the features unchanged.
+	UserFeatures uint32
+
+	// Netlink pid to send upcalls from the datapath's local port
+	// to.  When changing a datapath, zero leaves it unchanged.
+	UpcallPid uint32
+
+	// Number of entries in the kernel's flow mask cache.  Zero
+	// means the kernel's default when creating a datapath, and
+	// leaves it unchanged when changing a datapath.
+	MasksCacheSize uint32
+
+	// If non-empty, ask the kernel to send upcalls to the pid
+	// corresponding to the CPU that handled the packet
+	// (OVS_DP_F_DISPATCH_UPCALL_PER_CPU), rather than to the
+	// pids associated with each vport.
+	PerCPUUpcallPids []uint32
+}
+
+// USER_FEATURES is always included, because the kernel takes its
+// absence to mean no features.
+func (opts DatapathOptions) toNlAttrs(msg *NlMsgBuilder, features uint32) {
+	if len(opts.PerCPUUpcallPids) > 0 {
+		features |= OVS_DP_F_DISPATCH_UPCALL_PER_CPU
+	}
+
+	msg.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, features)
+
+	if opts.MasksCacheSize != 0 {
+		msg.PutUint32Attr(OVS_DP_ATTR_MASKS_CACHE_SIZE, opts.MasksCacheSize)
+	}
+
+	if len(opts.PerCPUUpcallPids) > 0 {
+		msg.PutUint32ArrayAttr(OVS_DP_ATTR_PER_CPU_PIDS, opts.PerCPUUpcallPids)
+	}
+}
+
+// Check the kernel's reply to a request that asked for per-CPU upcall
+// dispatch.  Kernels that predate it either reject the feature flag,
+// or silently drop it from the features they report.  A kernel that
+// echoes back feature bits it does not know about still does not
+// report the pids, so both are required.
+func checkPerCPUUpcalls(opts DatapathOptions, dpi datapathInfo, err error) error {
+	if len(opts.PerCPUUpcallPids) == 0 {
+		return err
+	}
+
+	if IsNetlinkError(err, syscall.EOPNOTSUPP) {
+		return ErrNoPerCPUUpcalls
+	}
+
+	if err == nil && (dpi.features&OVS_DP_F_DISPATCH_UPCALL_PER_CPU == 0 || dpi.perCPUUpcallPids == nil) {
+		return ErrNoPerCPUUpcalls
+	}
+
+	return err
 }
 
 func (dpif *Dpif) CreateDatapath(name string) (DatapathHandle, error) {
-	var features uint32 = OVS_DP_F_UNALIGNED | OVS_DP_F_VPORT_PIDS
+	return dpif.CreateDatapathWithOptions(name, DatapathOptions{})
+}
+
+// Create a datapath.  If opts.PerCPUUpcallPids is given but the kernel
+// does not support per-CPU upcall dispatch, this returns
+// ErrNoPerCPUUpcalls.  If the kernel created the datapath regardless,
+// a valid handle is returned along with the error, so that the caller
+// can fall back to per-vport upcall pids or delete the datapath.
+func (dpif *Dpif) CreateDatapathWithOptions(name string, opts DatapathOptions) (DatapathHandle, error) {
+	return dpif.CreateDatapathContext(context.Background(), name, opts)
+}
+
+func (dpif *Dpif) CreateDatapathContext(ctx context.Context, name string, opts DatapathOptions) (DatapathHandle, error) {
+	features := opts.UserFeatures
+	if features == 0 {
+		features = DefaultDatapathFeatures
+	}
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[DATAPATH])
 	req.PutGenlMsghdr(OVS_DP_CMD_NEW, OVS_DATAPATH_VERSION)
 	req.putOvsHeader(0)
 	req.PutStringAttr(OVS_DP_ATTR_NAME, name)
-	req.PutUint32Attr(OVS_DP_ATTR_UPCALL_PID, 0)
-	req.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, features)
+	req.PutUint32Attr(OVS_DP_ATTR_UPCALL_PID, opts.UpcallPid)
+	opts.toNlAttrs(req, features)
 
-	resp, err := dpif.sock.Request(req)
-	if err != nil {
-		return DatapathHandle{}, err
+	var dpi datapathInfo
+	resp, err := dpif.sock.RequestContext(ctx, req)
+	if err == nil {
+		dpi, err = dpif.parseDatapathInfo(resp)
 	}
 
-	dpi, err := dpif.parseDatapathInfo(resp)
+	perr := checkPerCPUUpcalls(opts, dpi, err)
 	if err != nil {
-		return DatapathHandle{}, err
+		return DatapathHandle{}, newOpError("create datapath", DATAPATH, name, nil, perr)
+	}
+
+	dp := DatapathHandle{dpif: dpif, ifindex: dpi.ifindex, name: dpi.name}
+	if perr != nil {
+		return dp, newOpError("create datapath", DATAPATH, name, nil, perr)
 	}
 
-	return DatapathHandle{dpif: dpif, ifindex: dpi.ifindex}, nil
+	return dp, nil
 }
 
 func (dpif *Dpif) LookupDatapath(name string) (DatapathHandle, error) {
+	return dpif.LookupDatapathContext(context.Background(), name)
+}
+
+func (dpif *Dpif) LookupDatapathContext(ctx context.Context, name string) (DatapathHandle, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[DATAPATH])
 	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
 	req.putOvsHeader(0)
 	req.PutStringAttr(OVS_DP_ATTR_NAME, name)
 
-	resp, err := dpif.sock.Request(req)
+	resp, err := dpif.request(ctx, "look up datapath", DATAPATH, name, req)
 	if err != nil {
 		return DatapathHandle{}, err
 	}
@@ -79,30 +232,143 @@ func (dpif *Dpif) LookupDatapath(name string) (DatapathHandle, error) {
 		return DatapathHandle{}, err
 	}
 
-	return DatapathHandle{dpif: dpif, ifindex: dpi.ifindex}, nil
+	return DatapathHandle{dpif: dpif, ifindex: dpi.ifindex, name: dpi.name}, nil
+}
+
+func (dp DatapathHandle) lookupInfo(ctx context.Context) (datapathInfo, error) {
+	req := NewNlMsgBuilder(RequestFlags, dp.dpif.familyIds[DATAPATH])
+	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
+	req.putOvsHeader(dp.ifindex)
+
+	resp, err := dp.dpif.request(ctx, "look up datapath", DATAPATH, dp.name, req)
+	if err != nil {
+		return datapathInfo{}, err
+	}
+
+	return dp.dpif.parseDatapathInfo(resp)
+}
+
+func (dp DatapathHandle) localVport() VportHandle {
+	return dp.NewVportHandle(OVSP_LOCAL)
+}
+
+// Get the datapath's current options.  UserFeatures holds the
+// features the kernel accepted, which may differ from those
+// requested.
+func (dp DatapathHandle) Options() (DatapathOptions, error) {
+	return dp.OptionsContext(context.Background())
+}
+
+func (dp DatapathHandle) OptionsContext(ctx context.Context) (DatapathOptions, error) {
+	dpi, err := dp.lookupInfo(ctx)
+	if err != nil {
+		return DatapathOptions{}, err
+	}
+
+	local, err := dp.localVport().LookupContext(ctx)
+	if err != nil {
+		return DatapathOptions{}, err
+	}
+
+	opts := DatapathOptions{
+		UserFeatures:     dpi.features,
+		MasksCacheSize:   dpi.masksCacheSize,
+		PerCPUUpcallPids: dpi.perCPUUpcallPids,
+	}
+
+	if len(local.UpcallPids) > 0 {
+		opts.UpcallPid = local.UpcallPids[0]
+	}
+
+	return opts, nil
+}
+
+// Change the datapath's options, using OVS_DP_CMD_SET.  Returns the
+// user features that the kernel accepted.  Kernels differ in how they
+// treat features they don't know about: newer ones fail with
+// EOPNOTSUPP, while older ones ignore them.
+func (dp DatapathHandle) Set(opts DatapathOptions) (uint32, error) {
+	return dp.SetContext(context.Background(), opts)
+}
+
+func (dp DatapathHandle) SetContext(ctx context.Context, opts DatapathOptions) (uint32, error) {
+	dpi, err := dp.lookupInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// USER_FEATURES replaces all the features, so unless new
+	// ones are given, preserve the existing ones.
+	features := opts.UserFeatures
+	if features == 0 {
+		features = dpi.features
+	}
+
+	if opts.UserFeatures != 0 || opts.MasksCacheSize != 0 || len(opts.PerCPUUpcallPids) > 0 {
+		req := NewNlMsgBuilder(RequestFlags, dp.dpif.familyIds[DATAPATH])
+		req.PutGenlMsghdr(OVS_DP_CMD_SET, OVS_DATAPATH_VERSION)
+		req.putOvsHeader(dp.ifindex)
+		opts.toNlAttrs(req, features)
+
+		resp, err := dp.dpif.sock.RequestContext(ctx, req)
+		if err == nil {
+			dpi, err = dp.dpif.parseDatapathInfo(resp)
+		}
+
+		if err := checkPerCPUUpcalls(opts, dpi, err); err != nil {
+			return 0, newOpError("set datapath options", DATAPATH, dp.name, nil, err)
+		}
+	}
+
+	if opts.UpcallPid != 0 {
+		err = dp.localVport().SetUpcallPidsContext(ctx, []uint32{opts.UpcallPid})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return dpi.features, nil
+}
+
+// Switch the datapath to sending upcalls to the pid corresponding to
+// the CPU that handled the packet.  Returns ErrNoPerCPUUpcalls if
+// the kernel does not support this, in which case upcalls continue to
+// go to the pids associated with each vport.
+func (dp DatapathHandle) SetPerCPUUpcallPids(pids []uint32) error {
+	_, err := dp.Set(DatapathOptions{PerCPUUpcallPids: pids})
+	return err
 }
 
 func IsNoSuchDatapathError(err error) bool {
-	return err == NetlinkError(syscall.ENODEV)
+	return errors.Is(err, ErrNoSuchDatapath)
 }
 
 func (dpif *Dpif) EnumerateDatapaths() (map[string]DatapathHandle, error) {
-	res := make(map[string]DatapathHandle)
+	return dpif.EnumerateDatapathsContext(context.Background())
+}
 
-	req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[DATAPATH])
-	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(0)
+func (dpif *Dpif) EnumerateDatapathsContext(ctx context.Context) (map[string]DatapathHandle, error) {
+	var res map[string]DatapathHandle
+
+	newReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[DATAPATH])
+		req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
+		req.putOvsHeader(0)
+		return req
+	}
+
+	reset := func() { res = make(map[string]DatapathHandle) }
 
 	consumer := func(resp *NlMsgParser) error {
 		dpi, err := dpif.parseDatapathInfo(resp)
 		if err != nil {
 			return err
 		}
-		res[dpi.name] = DatapathHandle{dpif: dpif, ifindex: dpi.ifindex}
+		res[dpi.name] = DatapathHandle{dpif: dpif, ifindex: dpi.ifindex, name: dpi.name}
 		return nil
 	}
 
-	err := dpif.sock.RequestMulti(req, consumer)
+	err := dpif.dump(ctx, "enumerate datapaths", DATAPATH, "", newReq, reset, consumer)
 	if err != nil {
 		return nil, err
 	}
@@ -111,11 +377,15 @@ func (dpif *Dpif) EnumerateDatapaths() (map[string]DatapathHandle, error) {
 }
 
 func (dp DatapathHandle) Delete() error {
+	return dp.DeleteContext(context.Background())
+}
+
+func (dp DatapathHandle) DeleteContext(ctx context.Context) error {
 	req := NewNlMsgBuilder(RequestFlags, dp.dpif.familyIds[DATAPATH])
 	req.PutGenlMsghdr(OVS_DP_CMD_DEL, OVS_DATAPATH_VERSION)
 	req.putOvsHeader(dp.ifindex)
 
-	_, err := dp.dpif.sock.Request(req)
+	_, err := dp.dpif.request(ctx, "delete datapath", DATAPATH, dp.name, req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,557 @@
+package odp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Decoding of raw netlink messages into a readable tree, for
+// debugging.  The decoder is deliberately forgiving: anything it
+// cannot make sense of is shown in hex rather than treated as an
+// error.
+
+type attrKind int
+
+const (
+	attrBytes attrKind = iota
+	attrFlag
+	attrUint8
+	attrUint16
+	attrUint32
+	attrUint64
+	attrUint32Array
+	attrString
+	attrIPv4
+	attrNested
+)
+
+type attrDesc struct {
+	name   string
+	kind   attrKind
+	nested *attrSpace
+}
+
+// A set of attribute types, named by the constants in syscall.go
+type attrSpace struct {
+	prefix string
+	attrs  map[uint16]attrDesc
+}
+
+var ctrlAttrs = &attrSpace{"CTRL_ATTR_", map[uint16]attrDesc{
+	CTRL_ATTR_FAMILY_ID:    {"FAMILY_ID", attrUint16, nil},
+	CTRL_ATTR_FAMILY_NAME:  {"FAMILY_NAME", attrString, nil},
+	CTRL_ATTR_VERSION:      {"VERSION", attrUint32, nil},
+	CTRL_ATTR_HDRSIZE:      {"HDRSIZE", attrUint32, nil},
+	CTRL_ATTR_MAXATTR:      {"MAXATTR", attrUint32, nil},
+	CTRL_ATTR_OPS:          {"OPS", attrBytes, nil},
+	CTRL_ATTR_MCAST_GROUPS: {"MCAST_GROUPS", attrBytes, nil},
+}}
+
+var extAckAttrs = &attrSpace{"NLMSGERR_ATTR_", map[uint16]attrDesc{
+	NLMSGERR_ATTR_MSG:  {"MSG", attrString, nil},
+	NLMSGERR_ATTR_OFFS: {"OFFS", attrUint32, nil},
+}}
+
+var dpAttrs = &attrSpace{"OVS_DP_ATTR_", map[uint16]attrDesc{
+	OVS_DP_ATTR_NAME:             {"NAME", attrString, nil},
+	OVS_DP_ATTR_UPCALL_PID:       {"UPCALL_PID", attrUint32, nil},
+	OVS_DP_ATTR_STATS:            {"STATS", attrBytes, nil},
+	OVS_DP_ATTR_MEGAFLOW_STATS:   {"MEGAFLOW_STATS", attrBytes, nil},
+	OVS_DP_ATTR_USER_FEATURES:    {"USER_FEATURES", attrUint32, nil},
+	OVS_DP_ATTR_PAD:              {"PAD", attrBytes, nil},
+	OVS_DP_ATTR_MASKS_CACHE_SIZE: {"MASKS_CACHE_SIZE", attrUint32, nil},
+	OVS_DP_ATTR_PER_CPU_PIDS:     {"PER_CPU_PIDS", attrUint32Array, nil},
+	OVS_DP_ATTR_IFINDEX:          {"IFINDEX", attrUint32, nil},
+}}
+
+var vxlanExtAttrs = &attrSpace{"OVS_VXLAN_EXT_", map[uint16]attrDesc{
+	OVS_VXLAN_EXT_GBP: {"GBP", attrFlag, nil},
+}}
+
+var tunnelAttrs = &attrSpace{"OVS_TUNNEL_ATTR_", map[uint16]attrDesc{
+	OVS_TUNNEL_ATTR_DST_PORT:  {"DST_PORT", attrUint16, nil},
+	OVS_TUNNEL_ATTR_EXTENSION: {"EXTENSION", attrNested, vxlanExtAttrs},
+}}
+
+var vportAttrs = &attrSpace{"OVS_VPORT_ATTR_", map[uint16]attrDesc{
+	OVS_VPORT_ATTR_PORT_NO:    {"PORT_NO", attrUint32, nil},
+	OVS_VPORT_ATTR_TYPE:       {"TYPE", attrUint32, nil},
+	OVS_VPORT_ATTR_NAME:       {"NAME", attrString, nil},
+	OVS_VPORT_ATTR_OPTIONS:    {"OPTIONS", attrNested, tunnelAttrs},
+	OVS_VPORT_ATTR_UPCALL_PID: {"UPCALL_PID", attrUint32Array, nil},
+	OVS_VPORT_ATTR_STATS:      {"STATS", attrBytes, nil},
+	OVS_VPORT_ATTR_PAD:        {"PAD", attrBytes, nil},
+	OVS_VPORT_ATTR_IFINDEX:    {"IFINDEX", attrUint32, nil},
+	OVS_VPORT_ATTR_NETNSID:    {"NETNSID", attrUint32, nil},
+}}
+
+var tunnelKeyAttrs = &attrSpace{"OVS_TUNNEL_KEY_ATTR_", map[uint16]attrDesc{
+	OVS_TUNNEL_KEY_ATTR_ID:            {"ID", attrBytes, nil},
+	OVS_TUNNEL_KEY_ATTR_IPV4_SRC:      {"IPV4_SRC", attrIPv4, nil},
+	OVS_TUNNEL_KEY_ATTR_IPV4_DST:      {"IPV4_DST", attrIPv4, nil},
+	OVS_TUNNEL_KEY_ATTR_TOS:           {"TOS", attrUint8, nil},
+	OVS_TUNNEL_KEY_ATTR_TTL:           {"TTL", attrUint8, nil},
+	OVS_TUNNEL_KEY_ATTR_DONT_FRAGMENT: {"DONT_FRAGMENT", attrFlag, nil},
+	OVS_TUNNEL_KEY_ATTR_CSUM:          {"CSUM", attrFlag, nil},
+}}
+
+// Key values that are structs in network byte order are shown in
+// hex.  Within OVS_ACTION_ATTR_SET_MASKED, values are followed by
+// their masks, so integer values show in hex too.
+var keyAttrs = &attrSpace{"OVS_KEY_ATTR_", map[uint16]attrDesc{
+	OVS_KEY_ATTR_PRIORITY:  {"PRIORITY", attrUint32, nil},
+	OVS_KEY_ATTR_IN_PORT:   {"IN_PORT", attrUint32, nil},
+	OVS_KEY_ATTR_ETHERNET:  {"ETHERNET", attrBytes, nil},
+	OVS_KEY_ATTR_VLAN:      {"VLAN", attrBytes, nil},
+	OVS_KEY_ATTR_ETHERTYPE: {"ETHERTYPE", attrBytes, nil},
+	OVS_KEY_ATTR_IPV4:      {"IPV4", attrBytes, nil},
+	OVS_KEY_ATTR_IPV6:      {"IPV6", attrBytes, nil},
+	OVS_KEY_ATTR_TCP:       {"TCP", attrBytes, nil},
+	OVS_KEY_ATTR_UDP:       {"UDP", attrBytes, nil},
+	OVS_KEY_ATTR_ICMP:      {"ICMP", attrBytes, nil},
+	OVS_KEY_ATTR_ICMPV6:    {"ICMPV6", attrBytes, nil},
+	OVS_KEY_ATTR_ARP:       {"ARP", attrBytes, nil},
+	OVS_KEY_ATTR_ND:        {"ND", attrBytes, nil},
+	OVS_KEY_ATTR_SKB_MARK:  {"SKB_MARK", attrUint32, nil},
+	OVS_KEY_ATTR_TUNNEL:    {"TUNNEL", attrNested, tunnelKeyAttrs},
+	OVS_KEY_ATTR_SCTP:      {"SCTP", attrBytes, nil},
+	OVS_KEY_ATTR_TCP_FLAGS: {"TCP_FLAGS", attrBytes, nil},
+}}
+
+var natAttrs = &attrSpace{"OVS_NAT_ATTR_", map[uint16]attrDesc{
+	OVS_NAT_ATTR_SRC:          {"SRC", attrFlag, nil},
+	OVS_NAT_ATTR_DST:          {"DST", attrFlag, nil},
+	OVS_NAT_ATTR_IP_MIN:       {"IP_MIN", attrBytes, nil},
+	OVS_NAT_ATTR_IP_MAX:       {"IP_MAX", attrBytes, nil},
+	OVS_NAT_ATTR_PROTO_MIN:    {"PROTO_MIN", attrUint16, nil},
+	OVS_NAT_ATTR_PROTO_MAX:    {"PROTO_MAX", attrUint16, nil},
+	OVS_NAT_ATTR_PERSISTENT:   {"PERSISTENT", attrFlag, nil},
+	OVS_NAT_ATTR_PROTO_HASH:   {"PROTO_HASH", attrFlag, nil},
+	OVS_NAT_ATTR_PROTO_RANDOM: {"PROTO_RANDOM", attrFlag, nil},
+}}
+
+var ctAttrs = &attrSpace{"OVS_CT_ATTR_", map[uint16]attrDesc{
+	OVS_CT_ATTR_COMMIT:       {"COMMIT", attrFlag, nil},
+	OVS_CT_ATTR_ZONE:         {"ZONE", attrUint16, nil},
+	OVS_CT_ATTR_MARK:         {"MARK", attrBytes, nil},
+	OVS_CT_ATTR_LABELS:       {"LABELS", attrBytes, nil},
+	OVS_CT_ATTR_HELPER:       {"HELPER", attrString, nil},
+	OVS_CT_ATTR_NAT:          {"NAT", attrNested, natAttrs},
+	OVS_CT_ATTR_FORCE_COMMIT: {"FORCE_COMMIT", attrFlag, nil},
+	OVS_CT_ATTR_EVENTMASK:    {"EVENTMASK", attrUint32, nil},
+	OVS_CT_ATTR_TIMEOUT:      {"TIMEOUT", attrString, nil},
+}}
+
+var checkPktLenAttrs = &attrSpace{"OVS_CHECK_PKT_LEN_ATTR_", map[uint16]attrDesc{
+	OVS_CHECK_PKT_LEN_ATTR_PKT_LEN: {"PKT_LEN", attrUint16, nil},
+}}
+
+var actionAttrs = &attrSpace{"OVS_ACTION_ATTR_", map[uint16]attrDesc{
+	OVS_ACTION_ATTR_OUTPUT:     {"OUTPUT", attrUint32, nil},
+	OVS_ACTION_ATTR_USERSPACE:  {"USERSPACE", attrBytes, nil},
+	OVS_ACTION_ATTR_SET:        {"SET", attrNested, keyAttrs},
+	OVS_ACTION_ATTR_PUSH_VLAN:  {"PUSH_VLAN", attrBytes, nil},
+	OVS_ACTION_ATTR_POP_VLAN:   {"POP_VLAN", attrFlag, nil},
+	OVS_ACTION_ATTR_SAMPLE:     {"SAMPLE", attrBytes, nil},
+	OVS_ACTION_ATTR_RECIRC:     {"RECIRC", attrUint32, nil},
+	OVS_ACTION_ATTR_HASH:       {"HASH", attrBytes, nil},
+	OVS_ACTION_ATTR_PUSH_MPLS:  {"PUSH_MPLS", attrBytes, nil},
+	OVS_ACTION_ATTR_POP_MPLS:   {"POP_MPLS", attrBytes, nil},
+	OVS_ACTION_ATTR_SET_MASKED: {"SET_MASKED", attrNested, keyAttrs},
+	OVS_ACTION_ATTR_CT:         {"CT", attrNested, ctAttrs},
+	OVS_ACTION_ATTR_TRUNC:      {"TRUNC", attrUint32, nil},
+	OVS_ACTION_ATTR_PUSH_ETH:   {"PUSH_ETH", attrBytes, nil},
+	OVS_ACTION_ATTR_POP_ETH:    {"POP_ETH", attrFlag, nil},
+	OVS_ACTION_ATTR_CT_CLEAR:   {"CT_CLEAR", attrFlag, nil},
+	OVS_ACTION_ATTR_PUSH_NSH:   {"PUSH_NSH", attrBytes, nil},
+	OVS_ACTION_ATTR_POP_NSH:    {"POP_NSH", attrFlag, nil},
+	OVS_ACTION_ATTR_METER:      {"METER", attrUint32, nil},
+}}
+
+var flowAttrs = &attrSpace{"OVS_FLOW_ATTR_", map[uint16]attrDesc{
+	OVS_FLOW_ATTR_KEY:       {"KEY", attrNested, keyAttrs},
+	OVS_FLOW_ATTR_ACTIONS:   {"ACTIONS", attrNested, actionAttrs},
+	OVS_FLOW_ATTR_STATS:     {"STATS", attrBytes, nil},
+	OVS_FLOW_ATTR_TCP_FLAGS: {"TCP_FLAGS", attrBytes, nil},
+	OVS_FLOW_ATTR_USED:      {"USED", attrUint64, nil},
+	OVS_FLOW_ATTR_CLEAR:     {"CLEAR", attrFlag, nil},
+	OVS_FLOW_ATTR_MASK:      {"MASK", attrNested, keyAttrs},
+}}
+
+var packetAttrs = &attrSpace{"OVS_PACKET_ATTR_", map[uint16]attrDesc{
+	OVS_PACKET_ATTR_PACKET:         {"PACKET", attrBytes, nil},
+	OVS_PACKET_ATTR_KEY:            {"KEY", attrNested, keyAttrs},
+	OVS_PACKET_ATTR_ACTIONS:        {"ACTIONS", attrNested, actionAttrs},
+	OVS_PACKET_ATTR_USERDATA:       {"USERDATA", attrBytes, nil},
+	OVS_PACKET_ATTR_EGRESS_TUN_KEY: {"EGRESS_TUN_KEY", attrNested, tunnelKeyAttrs},
+	OVS_PACKET_ATTR_PROBE:          {"PROBE", attrFlag, nil},
+	OVS_PACKET_ATTR_MRU:            {"MRU", attrUint16, nil},
+	OVS_PACKET_ATTR_LEN:            {"LEN", attrUint32, nil},
+	OVS_PACKET_ATTR_HASH:           {"HASH", attrUint64, nil},
+}}
+
+var bandAttrs = &attrSpace{"OVS_BAND_ATTR_", map[uint16]attrDesc{
+	OVS_BAND_ATTR_TYPE:  {"TYPE", attrUint32, nil},
+	OVS_BAND_ATTR_RATE:  {"RATE", attrUint32, nil},
+	OVS_BAND_ATTR_BURST: {"BURST", attrUint32, nil},
+	OVS_BAND_ATTR_STATS: {"STATS", attrBytes, nil},
+}}
+
+// Each band within OVS_METER_ATTR_BANDS is a nested attribute of
+// type OVS_BAND_ATTR_UNSPEC
+var bandListAttrs = &attrSpace{"OVS_BAND_ATTR_", map[uint16]attrDesc{
+	OVS_BAND_ATTR_UNSPEC: {"UNSPEC", attrNested, bandAttrs},
+}}
+
+var meterAttrs = &attrSpace{"OVS_METER_ATTR_", map[uint16]attrDesc{
+	OVS_METER_ATTR_ID:         {"ID", attrUint32, nil},
+	OVS_METER_ATTR_KBPS:       {"KBPS", attrFlag, nil},
+	OVS_METER_ATTR_STATS:      {"STATS", attrBytes, nil},
+	OVS_METER_ATTR_BANDS:      {"BANDS", attrNested, bandListAttrs},
+	OVS_METER_ATTR_MAX_METERS: {"MAX_METERS", attrUint32, nil},
+	OVS_METER_ATTR_MAX_BANDS:  {"MAX_BANDS", attrUint32, nil},
+	OVS_METER_ATTR_PAD:        {"PAD", attrBytes, nil},
+	OVS_METER_ATTR_USED:       {"USED", attrUint64, nil},
+	OVS_METER_ATTR_CLEAR:      {"CLEAR", attrFlag, nil},
+}}
+
+var ctLimitAttrs = &attrSpace{"OVS_CT_LIMIT_ATTR_", map[uint16]attrDesc{
+	OVS_CT_LIMIT_ATTR_ZONE_LIMIT: {"ZONE_LIMIT", attrBytes, nil},
+}}
+
+func init() {
+	// These refer back to the spaces containing them, so they
+	// can't go in the initializers
+	keyAttrs.attrs[OVS_KEY_ATTR_ENCAP] = attrDesc{"ENCAP", attrNested, keyAttrs}
+	actionAttrs.attrs[OVS_ACTION_ATTR_CLONE] = attrDesc{"CLONE", attrNested, actionAttrs}
+	actionAttrs.attrs[OVS_ACTION_ATTR_CHECK_PKT_LEN] = attrDesc{"CHECK_PKT_LEN", attrNested, checkPktLenAttrs}
+	checkPktLenAttrs.attrs[OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_GREATER] = attrDesc{"ACTIONS_IF_GREATER", attrNested, actionAttrs}
+	checkPktLenAttrs.attrs[OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_LESS_EQUAL] = attrDesc{"ACTIONS_IF_LESS_EQUAL", attrNested, actionAttrs}
+}
+
+type genlFamilyDesc struct {
+	cmdPrefix string
+	cmds      map[uint8]string
+
+	// Whether messages have an OvsHeader after the GenlMsghdr
+	ovsHeader bool
+	attrs     *attrSpace
+}
+
+const ctrlFamilyName = "nlctrl"
+
+var genlFamilyDescs = map[string]*genlFamilyDesc{
+	ctrlFamilyName: {"CTRL_CMD_", map[uint8]string{
+		CTRL_CMD_NEWFAMILY:    "NEWFAMILY",
+		CTRL_CMD_DELFAMILY:    "DELFAMILY",
+		CTRL_CMD_GETFAMILY:    "GETFAMILY",
+		CTRL_CMD_NEWOPS:       "NEWOPS",
+		CTRL_CMD_DELOPS:       "DELOPS",
+		CTRL_CMD_GETOPS:       "GETOPS",
+		CTRL_CMD_NEWMCAST_GRP: "NEWMCAST_GRP",
+		CTRL_CMD_DELMCAST_GRP: "DELMCAST_GRP",
+	}, false, ctrlAttrs},
+	"ovs_datapath": {"OVS_DP_CMD_", map[uint8]string{
+		OVS_DP_CMD_NEW: "NEW",
+		OVS_DP_CMD_DEL: "DEL",
+		OVS_DP_CMD_GET: "GET",
+		OVS_DP_CMD_SET: "SET",
+	}, true, dpAttrs},
+	"ovs_vport": {"OVS_VPORT_CMD_", map[uint8]string{
+		OVS_VPORT_CMD_NEW: "NEW",
+		OVS_VPORT_CMD_DEL: "DEL",
+		OVS_VPORT_CMD_GET: "GET",
+		OVS_VPORT_CMD_SET: "SET",
+	}, true, vportAttrs},
+	"ovs_flow": {"OVS_FLOW_CMD_", map[uint8]string{
+		OVS_FLOW_CMD_NEW: "NEW",
+		OVS_FLOW_CMD_DEL: "DEL",
+		OVS_FLOW_CMD_GET: "GET",
+		OVS_FLOW_CMD_SET: "SET",
+	}, true, flowAttrs},
+	"ovs_packet": {"OVS_PACKET_CMD_", map[uint8]string{
+		OVS_PACKET_CMD_MISS:    "MISS",
+		OVS_PACKET_CMD_ACTION:  "ACTION",
+		OVS_PACKET_CMD_EXECUTE: "EXECUTE",
+	}, true, packetAttrs},
+	"ovs_meter": {"OVS_METER_CMD_", map[uint8]string{
+		OVS_METER_CMD_FEATURES: "FEATURES",
+		OVS_METER_CMD_SET:      "SET",
+		OVS_METER_CMD_DEL:      "DEL",
+		OVS_METER_CMD_GET:      "GET",
+	}, true, meterAttrs},
+	"ovs_ct_limit": {"OVS_CT_LIMIT_CMD_", map[uint8]string{
+		OVS_CT_LIMIT_CMD_SET: "SET",
+		OVS_CT_LIMIT_CMD_DEL: "DEL",
+		OVS_CT_LIMIT_CMD_GET: "GET",
+	}, true, ctLimitAttrs},
+}
+
+var nlMsgTypeNames = map[uint16]string{
+	syscall.NLMSG_NOOP:    "NLMSG_NOOP",
+	syscall.NLMSG_ERROR:   "NLMSG_ERROR",
+	syscall.NLMSG_DONE:    "NLMSG_DONE",
+	syscall.NLMSG_OVERRUN: "NLMSG_OVERRUN",
+}
+
+type flagName struct {
+	flag uint16
+	name string
+}
+
+var nlMsgFlagNames = []flagName{
+	{syscall.NLM_F_REQUEST, "REQUEST"},
+	{syscall.NLM_F_MULTI, "MULTI"},
+	{syscall.NLM_F_ACK, "ACK"},
+	{syscall.NLM_F_ECHO, "ECHO"},
+	{NLM_F_DUMP_INTR, "DUMP_INTR"},
+}
+
+// The meanings of the higher flag bits depend on the message
+var nlRequestFlagNames = []flagName{
+	{syscall.NLM_F_ROOT, "ROOT"},
+	{syscall.NLM_F_MATCH, "MATCH"},
+	{syscall.NLM_F_ATOMIC, "ATOMIC"},
+}
+
+var nlErrorFlagNames = []flagName{
+	{NLM_F_CAPPED, "CAPPED"},
+	{NLM_F_ACK_TLVS, "ACK_TLVS"},
+}
+
+type nlDecoder struct {
+	families map[uint16]string
+	out      strings.Builder
+}
+
+func (d *nlDecoder) line(depth int, f string, a ...interface{}) {
+	d.out.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(&d.out, f, a...)
+	d.out.WriteByte('\n')
+}
+
+// Render the netlink messages in a datagram as an indented tree,
+// one line per header or attribute.  families maps generic netlink
+// family ids to family names (as returned by Dpif.FamilyNames); it
+// may be nil, in which case only the generic netlink controller
+// family is recognized.
+func DecodeNetlinkMessages(data []byte, families map[uint16]string) string {
+	d := nlDecoder{families: families}
+
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < syscall.NLMSG_HDRLEN {
+			d.line(0, "truncated netlink message header: %s", hex.EncodeToString(data[pos:]))
+			break
+		}
+
+		h := nlMsghdrAt(data, pos)
+		if int(h.Len) < syscall.NLMSG_HDRLEN || int(h.Len) > len(data)-pos {
+			d.line(0, "bad netlink message length %d: %s", h.Len, hex.EncodeToString(data[pos:]))
+			break
+		}
+
+		d.message(0, h, data[pos+syscall.NLMSG_HDRLEN:pos+int(h.Len)])
+		pos = align(pos+int(h.Len), syscall.NLMSG_ALIGNTO)
+	}
+
+	return d.out.String()
+}
+
+func (d *nlDecoder) familyName(typ uint16) string {
+	if typ == GENL_ID_CTRL {
+		return ctrlFamilyName
+	}
+
+	return d.families[typ]
+}
+
+func flagsString(flags uint16, names ...[]flagName) string {
+	var res []string
+	for _, ns := range names {
+		for _, n := range ns {
+			if flags&n.flag != 0 {
+				res = append(res, n.name)
+				flags &^= n.flag
+			}
+		}
+	}
+
+	if flags != 0 || res == nil {
+		res = append(res, fmt.Sprintf("0x%x", flags))
+	}
+
+	return strings.Join(res, "|")
+}
+
+func (d *nlDecoder) message(depth int, h *syscall.NlMsghdr, payload []byte) {
+	typ, ok := nlMsgTypeNames[h.Type]
+	family := ""
+	if !ok {
+		family = d.familyName(h.Type)
+		if family != "" {
+			typ = family
+		} else {
+			typ = fmt.Sprint(h.Type)
+		}
+	}
+
+	var flags string
+	switch {
+	case h.Type == syscall.NLMSG_ERROR:
+		flags = flagsString(h.Flags, nlMsgFlagNames, nlErrorFlagNames)
+	case h.Flags&syscall.NLM_F_REQUEST != 0:
+		flags = flagsString(h.Flags, nlMsgFlagNames, nlRequestFlagNames)
+	default:
+		flags = flagsString(h.Flags, nlMsgFlagNames)
+	}
+
+	d.line(depth, "netlink message: len=%d type=%s flags=%s seq=%d pid=%d", h.Len, typ, flags, h.Seq, h.Pid)
+	depth++
+
+	switch {
+	case h.Type == syscall.NLMSG_ERROR:
+		d.errorMessage(depth, h, payload)
+
+	case h.Type < syscall.NLMSG_MIN_TYPE:
+		if len(payload) > 0 {
+			d.line(depth, "payload: %s", hex.EncodeToString(payload))
+		}
+
+	default:
+		desc := genlFamilyDescs[family]
+		if desc == nil {
+			d.line(depth, "payload: %s", hex.EncodeToString(payload))
+			return
+		}
+
+		d.genlMessage(depth, desc, payload)
+	}
+}
+
+func (d *nlDecoder) errorMessage(depth int, h *syscall.NlMsghdr, payload []byte) {
+	if len(payload) < syscall.SizeofNlMsgerr {
+		d.line(depth, "truncated error: %s", hex.EncodeToString(payload))
+		return
+	}
+
+	nlerr := nlMsgerrAt(payload, 0)
+	if nlerr.Error == 0 {
+		d.line(depth, "ack")
+	} else {
+		d.line(depth, "error: %d (%s)", -nlerr.Error, syscall.Errno(-nlerr.Error))
+	}
+
+	d.line(depth, "request: len=%d type=%d flags=0x%x seq=%d pid=%d",
+		nlerr.Msg.Len, nlerr.Msg.Type, nlerr.Msg.Flags, nlerr.Msg.Seq, nlerr.Msg.Pid)
+
+	if h.Flags&NLM_F_ACK_TLVS == 0 {
+		return
+	}
+
+	// The extended ACK attributes follow the original request,
+	// or just its header if the reply is capped
+	pos := syscall.SizeofNlMsgerr
+	if h.Flags&NLM_F_CAPPED == 0 {
+		pos += int(nlerr.Msg.Len) - syscall.NLMSG_HDRLEN
+	}
+	pos = align(pos, syscall.NLMSG_ALIGNTO)
+
+	if pos > len(payload) {
+		d.line(depth, "truncated request: %s", hex.EncodeToString(payload[syscall.SizeofNlMsgerr:]))
+		return
+	}
+
+	d.attrs(depth, extAckAttrs, payload[pos:])
+}
+
+func (d *nlDecoder) genlMessage(depth int, desc *genlFamilyDesc, payload []byte) {
+	if len(payload) < SizeofGenlMsghdr {
+		d.line(depth, "truncated genl header: %s", hex.EncodeToString(payload))
+		return
+	}
+
+	gh := genlMsghdrAt(payload, 0)
+	cmd, ok := desc.cmds[gh.Cmd]
+	if ok {
+		cmd = desc.cmdPrefix + cmd
+	} else {
+		cmd = fmt.Sprint(gh.Cmd)
+	}
+
+	d.line(depth, "genl: cmd=%s version=%d", cmd, gh.Version)
+	pos := align(SizeofGenlMsghdr, syscall.NLMSG_ALIGNTO)
+
+	if desc.ovsHeader {
+		if len(payload) < pos+SizeofOvsHeader {
+			d.line(depth, "truncated ovs header: %s", hex.EncodeToString(payload[pos:]))
+			return
+		}
+
+		d.line(depth, "ovs: dp_ifindex=%d", ovsHeaderAt(payload, pos).DpIfIndex)
+		pos = align(pos+SizeofOvsHeader, syscall.NLMSG_ALIGNTO)
+	}
+
+	d.attrs(depth, desc.attrs, payload[pos:])
+}
+
+func (d *nlDecoder) attrs(depth int, space *attrSpace, data []byte) {
+	attrs, err := ParseOrderedAttrs(data)
+	for _, attr := range attrs {
+		d.attr(depth, space, attr)
+	}
+
+	if err != nil {
+		d.line(depth, "%s", err)
+	}
+}
+
+func (d *nlDecoder) attr(depth int, space *attrSpace, attr Attr) {
+	typ := attr.typ & NLA_TYPE_MASK
+	desc, ok := space.attrs[typ]
+	name := space.prefix + desc.name
+	if !ok {
+		name = fmt.Sprintf("%s%d", space.prefix, typ)
+	}
+
+	val := attr.val
+	if desc.kind == attrNested {
+		d.line(depth, "%s", name)
+		d.attrs(depth+1, desc.nested, val)
+		return
+	}
+
+	d.line(depth, "%s%s", name, formatAttrValue(desc.kind, val))
+}
+
+func formatAttrValue(kind attrKind, val []byte) string {
+	switch {
+	case kind == attrFlag && len(val) == 0:
+		return ""
+	case kind == attrUint8 && len(val) == 1:
+		return fmt.Sprintf(": %d", val[0])
+	case kind == attrUint16 && len(val) == 2:
+		return fmt.Sprintf(": %d", *uint16At(val, 0))
+	case kind == attrUint32 && len(val) == 4:
+		return fmt.Sprintf(": %d", *uint32At(val, 0))
+	case kind == attrUint64 && len(val) == 8:
+		return fmt.Sprintf(": %d", *uint64At(val, 0))
+	case kind == attrIPv4 && len(val) == 4:
+		return fmt.Sprintf(": %s", net.IP(val))
+	case kind == attrUint32Array && len(val)%4 == 0:
+		var vals []string
+		for i := 0; i < len(val); i += 4 {
+			vals = append(vals, fmt.Sprint(*uint32At(val, i)))
+		}
+		return fmt.Sprintf(": [%s]", strings.Join(vals, " "))
+	case kind == attrString && len(val) > 0 && val[len(val)-1] == 0:
+		return fmt.Sprintf(": %q", val[:len(val)-1])
+	case len(val) == 0:
+		return ": (empty)"
+	default:
+		return fmt.Sprintf(": %s", hex.EncodeToString(val))
+	}
+}
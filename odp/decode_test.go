@@ -0,0 +1,74 @@
+package odp
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDecodeNetlinkMessages(t *testing.T) {
+	const flowFamily = 0x20
+
+	req := NewNlMsgBuilder(RequestFlags, flowFamily)
+	req.PutGenlMsghdr(OVS_FLOW_CMD_NEW, OVS_FLOW_VERSION)
+	req.putOvsHeader(7)
+	req.PutNestedAttrs(OVS_FLOW_ATTR_KEY, func() {
+		req.PutUint32Attr(OVS_KEY_ATTR_IN_PORT, 3)
+		req.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
+			req.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_DST, []byte{10, 0, 0, 1})
+			req.PutEmptyAttr(OVS_TUNNEL_KEY_ATTR_CSUM)
+		})
+	})
+	req.PutNestedAttrs(OVS_FLOW_ATTR_ACTIONS, func() {
+		req.PutUint32Attr(OVS_ACTION_ATTR_OUTPUT, 2)
+		req.PutUint32Attr(99, 0)
+	})
+	data, _ := req.Finish()
+
+	expect := `netlink message: len=%d type=ovs_flow flags=REQUEST|ECHO seq=%d pid=0
+  genl: cmd=OVS_FLOW_CMD_NEW version=1
+  ovs: dp_ifindex=7
+  OVS_FLOW_ATTR_KEY
+    OVS_KEY_ATTR_IN_PORT: 3
+    OVS_KEY_ATTR_TUNNEL
+      OVS_TUNNEL_KEY_ATTR_IPV4_DST: 10.0.0.1
+      OVS_TUNNEL_KEY_ATTR_CSUM
+  OVS_FLOW_ATTR_ACTIONS
+    OVS_ACTION_ATTR_OUTPUT: 2
+    OVS_ACTION_ATTR_99: 00000000
+`
+	h := nlMsghdrAt(data, 0)
+	expect = fmt.Sprintf(expect, h.Len, h.Seq)
+
+	got := DecodeNetlinkMessages(data, map[uint16]string{flowFamily: "ovs_flow"})
+	if got != expect {
+		t.Fatal(got)
+	}
+
+	// Without the family names, the payload is just shown in hex
+	got = DecodeNetlinkMessages(data, nil)
+	if !strings.Contains(got, "type=32 ") || !strings.Contains(got, "payload: ") {
+		t.Fatal(got)
+	}
+
+	// Garbage does not upset it
+	got = DecodeNetlinkMessages(data[:30], nil)
+	if !strings.HasPrefix(got, "bad netlink message length") {
+		t.Fatal(got)
+	}
+}
+
+func TestDecodeErrorMessage(t *testing.T) {
+	msg := NewNlMsgBuilder(0, syscall.NLMSG_ERROR)
+	pos := msg.AlignGrow(syscall.NLMSG_ALIGNTO, syscall.SizeofNlMsgerr)
+	nlerr := nlMsgerrAt(msg.buf, pos)
+	nlerr.Error = -int32(syscall.ENOENT)
+	nlerr.Msg = syscall.NlMsghdr{Len: syscall.SizeofNlMsghdr, Type: GENL_ID_CTRL}
+	data, _ := msg.Finish()
+
+	got := DecodeNetlinkMessages(data, nil)
+	if !strings.Contains(got, "error: 2 (no such file or directory)") || !strings.Contains(got, "request: len=16 type=16 ") {
+		t.Fatal(got)
+	}
+}
@@ -1,7 +1,10 @@
 package odp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"syscall"
 )
 
@@ -10,6 +13,8 @@ const (
 	VPORT        = iota
 	FLOW         = iota
 	PACKET       = iota
+	METER        = iota
+	CT_LIMIT     = iota
 	FAMILY_COUNT = iota
 )
 
@@ -18,36 +23,95 @@ var familyNames = [FAMILY_COUNT]string{
 	"ovs_vport",
 	"ovs_flow",
 	"ovs_packet",
+	"ovs_meter",
+	"ovs_ct_limit",
 }
 
+// Families that only exist in newer kernels.  If they are not
+// available, the corresponding familyIds entry is left as zero, and
+// operations that need them fail.
+var optionalFamilies = [FAMILY_COUNT]bool{
+	METER:    true,
+	CT_LIMIT: true,
+}
+
+// A Dpif may be used by many goroutines at once, except that Close
+// must not be called concurrently with other operations.
 type Dpif struct {
-	sock      *NetlinkSocket
-	familyIds [FAMILY_COUNT]uint16
+	sock        *NetlinkSocket
+	familyIds   [FAMILY_COUNT]uint16
+	dumpRetries int
+
+	// Opens further sockets talking to the same kernel, e.g.
+	// for upcalls
+	openSocket func() (*NetlinkSocket, error)
+}
+
+// The number of times the Enumerate functions repeat a dump that the
+// kernel reports was interrupted by concurrent changes, unless
+// changed with SetDumpRetries.
+const DefaultDumpRetries = 5
+
+func familyOpError(family int, kind error, err error) error {
+	return &OpError{
+		Op:     fmt.Sprintf("look up generic netlink family '%s'", familyNames[family]),
+		Family: familyNames[family],
+		Kind:   kind,
+		Err:    err,
+	}
 }
 
-func lookupFamily(sock *NetlinkSocket, name string) (uint16, error) {
-	id, err := sock.LookupGenlFamily(name)
+func lookupFamily(ctx context.Context, sock *NetlinkSocket, family int) (uint16, error) {
+	id, err := sock.LookupGenlFamilyContext(ctx, familyNames[family])
 	if err == nil {
 		return id, nil
 	}
 
-	if err == NetlinkError(syscall.ENOENT) {
-		return 0, fmt.Errorf("Generic netlink family '%s' unavailable; the Open vSwitch kernel module is probably not loaded", name)
+	if IsNetlinkError(err, syscall.ENOENT) {
+		if optionalFamilies[family] {
+			return 0, familyOpError(family, ErrNotSupported, err)
+		}
+
+		return 0, familyOpError(family, ErrModuleNotLoaded, err)
 	}
 
-	return 0, err
+	return 0, familyOpError(family, nil, err)
+}
+
+func openGenlSocket() (*NetlinkSocket, error) {
+	return OpenNetlinkSocket(syscall.NETLINK_GENERIC)
 }
 
 func NewDpif() (*Dpif, error) {
-	sock, err := OpenNetlinkSocket(syscall.NETLINK_GENERIC)
+	return NewDpifContext(context.Background())
+}
+
+func NewDpifContext(ctx context.Context) (*Dpif, error) {
+	sock, err := openGenlSocket()
 	if err != nil {
 		return nil, err
 	}
 
-	dpif := &Dpif{sock: sock}
+	return NewDpifWithSocket(ctx, sock)
+}
+
+// Create a Dpif on a generic netlink socket that the caller has
+// opened, e.g. in order to set a tracer on it first.  The Dpif takes
+// ownership of the socket, closing it on error.
+func NewDpifWithSocket(ctx context.Context, sock *NetlinkSocket) (*Dpif, error) {
+	var err error
+	dpif := &Dpif{
+		sock:        sock,
+		dumpRetries: DefaultDumpRetries,
+		openSocket:  openGenlSocket,
+	}
 
 	for i := 0; i < FAMILY_COUNT; i++ {
-		dpif.familyIds[i], err = lookupFamily(sock, familyNames[i])
+		dpif.familyIds[i], err = lookupFamily(ctx, sock, i)
+		if optionalFamilies[i] && errors.Is(err, ErrNotSupported) {
+			continue
+		}
+
 		if err != nil {
 			sock.Close()
 			return nil, err
@@ -57,6 +121,60 @@ func NewDpif() (*Dpif, error) {
 	return dpif, nil
 }
 
+// The names of the generic netlink families in use, by family id,
+// for DecodeNetlinkMessages.
+func (dpif *Dpif) FamilyNames() map[uint16]string {
+	res := make(map[uint16]string)
+	for i, id := range dpif.familyIds {
+		if id != 0 {
+			res[id] = familyNames[i]
+		}
+	}
+	return res
+}
+
+// Check that an optional family is supported by the kernel
+func (dpif *Dpif) checkFamily(family int) error {
+	if dpif.familyIds[family] == 0 {
+		return familyOpError(family, ErrNotSupported, nil)
+	}
+
+	return nil
+}
+
+// Set how many times the Enumerate functions repeat an interrupted
+// dump before giving up and returning ErrDumpInterrupted.  Zero
+// disables retries.  This should be called before the Dpif is
+// shared between goroutines.
+func (dpif *Dpif) SetDumpRetries(n int) {
+	dpif.dumpRetries = n
+}
+
+// Do a dump, retrying it if it is interrupted, and wrapping any error
+// in an OpError.  Each attempt builds a fresh request and calls reset
+// before the consumer sees any messages, so that results from an
+// interrupted attempt can be discarded.
+func (dpif *Dpif) dump(ctx context.Context, op string, family int, dpname string, newReq func() *NlMsgBuilder, reset func(), consumer func(*NlMsgParser) error) error {
+	for attempt := 0; ; attempt++ {
+		reset()
+		err := dpif.sock.RequestMultiContext(ctx, newReq(), consumer)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrDumpInterrupted) || attempt >= dpif.dumpRetries {
+			return newOpError(op, family, dpname, nil, err)
+		}
+
+		dpif.sock.log().Debug("retrying interrupted dump", "op", op, "datapath", dpname, "attempt", attempt+1)
+	}
+}
+
+// Set the logger for diagnostics.  See NetlinkSocket.SetLogger.
+func (dpif *Dpif) SetLogger(logger *slog.Logger) {
+	dpif.sock.SetLogger(logger)
+}
+
 func (dpif *Dpif) Close() error {
 	if dpif.sock == nil {
 		return nil
@@ -1,8 +1,11 @@
 package odp
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"math/rand"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -11,6 +14,19 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
+var kernel = flag.Bool("kernel", false, "run the Dpif tests against the kernel, which needs root and the openvswitch module")
+
+// Shared so that tests can check that state outlives a Dpif
+var fakeKernel = NewFakeKernel()
+
+func newTestDpif() (*Dpif, error) {
+	if *kernel {
+		return NewDpif()
+	}
+
+	return fakeKernel.NewDpif()
+}
+
 func checkedCloseDpif(dpif *Dpif, t *testing.T) {
 	err := dpif.Close()
 	if err != nil {
@@ -19,7 +35,7 @@ func checkedCloseDpif(dpif *Dpif, t *testing.T) {
 }
 
 func TestCreateDatapath(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,7 +55,7 @@ func TestCreateDatapath(t *testing.T) {
 }
 
 func TestLookupDatapath(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +73,7 @@ func TestLookupDatapath(t *testing.T) {
 	}
 
 	checkedCloseDpif(dpif, t)
-	dpif, err = NewDpif()
+	dpif, err = newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,7 +91,7 @@ func TestLookupDatapath(t *testing.T) {
 }
 
 func TestEnumerateDatapaths(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,6 +143,89 @@ func TestEnumerateDatapaths(t *testing.T) {
 	}
 }
 
+func TestDatapathOptions(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapathWithOptions(fmt.Sprintf("test%d", rand.Intn(100000)),
+		DatapathOptions{UpcallPid: dpif.sock.Pid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	opts, err := dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.UpcallPid != dpif.sock.Pid() {
+		t.Fatal(opts.UpcallPid)
+	}
+
+	features, err := dp.Set(DatapathOptions{UpcallPid: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if features != opts.UserFeatures {
+		t.Fatal(features)
+	}
+
+	opts, err = dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.UpcallPid != 1000 {
+		t.Fatal(opts.UpcallPid)
+	}
+}
+
+func TestDatapathSetPreservesFeatures(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	before, err := dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before.UserFeatures == 0 {
+		t.Fatal(before.UserFeatures)
+	}
+
+	features, err := dp.Set(DatapathOptions{MasksCacheSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if features != before.UserFeatures {
+		t.Fatal(features)
+	}
+
+	after, err := dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.UserFeatures != before.UserFeatures || after.MasksCacheSize != 512 {
+		t.Fatal(after)
+	}
+}
+
 func checkedDeleteDatapath(dp DatapathHandle, t *testing.T) {
 	err := dp.Delete()
 	if err != nil {
@@ -135,7 +234,7 @@ func checkedDeleteDatapath(dp DatapathHandle, t *testing.T) {
 }
 
 func TestCreateVport(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -160,7 +259,7 @@ func TestCreateVport(t *testing.T) {
 }
 
 func TestLookupVport(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -184,7 +283,7 @@ func TestLookupVport(t *testing.T) {
 	}
 
 	checkedCloseDpif(dpif, t)
-	dpif, err = NewDpif()
+	dpif, err = newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -207,8 +306,101 @@ func TestLookupVport(t *testing.T) {
 	}
 }
 
+func TestCreateVportPortNo(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	opts := VportOptions{PortNo: 42}
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	vport, err := dp.CreateVportWithOptions(NewInternalVportSpec(name), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vport.portNo != 42 {
+		t.Fatal(vport.portNo)
+	}
+
+	name = fmt.Sprintf("test%d", rand.Intn(100000))
+	_, err = dp.CreateVportWithOptions(NewInternalVportSpec(name), opts)
+	if !IsPortNoInUseError(err) {
+		t.Fatal(err)
+	}
+
+	err = vport.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreHandles(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dpname := fmt.Sprintf("test%d", rand.Intn(100000))
+	dp, err := dpif.CreateDatapath(dpname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dp.Name() != dpname {
+		t.Fatal(dp.Name())
+	}
+
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	vport, err := dp.CreateVport(NewInternalVportSpec(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dp2 := vport.Datapath()
+	if dp2.IfIndex() != dp.IfIndex() {
+		t.Fatal(dp2.IfIndex())
+	}
+
+	gotdpname, err := dp2.LookupName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotdpname != dpname {
+		t.Fatal(gotdpname)
+	}
+
+	checkedCloseDpif(dpif, t)
+	dpif, err = newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp = dpif.NewDatapathHandle(dp.IfIndex(), dp.Name())
+	defer checkedDeleteDatapath(dp, t)
+
+	got, err := dp.NewVportHandle(vport.PortNo()).Lookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Spec.Name() != name {
+		t.Fatal(got.Spec.Name())
+	}
+}
+
 func TestEnumerateVports(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -272,13 +464,130 @@ func TestEnumerateVports(t *testing.T) {
 	}
 }
 
+func TestEnumerateVportsDeletedDatapath(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkedDeleteDatapath(dp, t)
+
+	_, err = dp.EnumerateVports()
+	if !IsNoSuchDatapathError(err) || !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestEnumerateAllVports(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dpname := fmt.Sprintf("test%d", rand.Intn(100000))
+	dp, err := dpif.CreateDatapath(dpname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	_, err = dp.CreateVport(NewInternalVportSpec(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dpvports, err := dpif.EnumerateAllVports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, vport := range dpvports[dpname] {
+		if vport.Spec.Name() == name {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal(dpvports)
+	}
+}
+
+func TestEnumerateAllVportsDeletedDatapath(t *testing.T) {
+	k := NewFakeKernel()
+	dpif, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dpif2, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif2, t)
+
+	dp1, err := dpif.CreateDatapath("vanishing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dp2, err := dpif.CreateDatapath("remaining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp2, t)
+
+	// Delete the first datapath just before its vports are
+	// dumped, i.e. after the datapaths were enumerated
+	vportFamily := dpif.familyIds[VPORT]
+	deleted := false
+	k.lock.Lock()
+	k.sendHook = func(data []byte) {
+		h := nlMsghdrAt(data, 0)
+		if deleted || h.Type != vportFamily || h.Flags&syscall.NLM_F_DUMP == 0 {
+			return
+		}
+
+		ovshdr := ovsHeaderAt(data, syscall.NLMSG_HDRLEN+SizeofGenlMsghdr)
+		if ovshdr.DpIfIndex == dp1.IfIndex() {
+			deleted = true
+			if err := dpif2.NewDatapathHandle(dp1.IfIndex(), "").Delete(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	k.lock.Unlock()
+
+	dpvports, err := dpif.EnumerateAllVports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deleted {
+		t.Fatal("datapath not deleted")
+	}
+
+	if _, ok := dpvports["vanishing"]; ok || len(dpvports["remaining"]) != 1 {
+		t.Fatal(dpvports)
+	}
+}
+
 var exactOvsKeyEthernetMask OvsKeyEthernet = OvsKeyEthernet{
 	EthSrc: [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 	EthDst: [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 }
 
 func TestCreateFlow(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -314,13 +623,13 @@ func TestCreateFlow(t *testing.T) {
 	}
 
 	err = dp.DeleteFlow(f)
-	if err != (NoSuchFlowError{}) {
-		t.Fatal()
+	if !errors.Is(err, ErrNoSuchFlow) {
+		t.Fatal(err)
 	}
 }
 
 func TestEnumerateFlows(t *testing.T) {
-	dpif, err := NewDpif()
+	dpif, err := newTestDpif()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -395,3 +704,210 @@ func TestEnumerateFlows(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func checkUpcallPids(vport VportHandle, expect []uint32, t *testing.T) {
+	got, err := vport.Lookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.UpcallPids) != len(expect) {
+		t.Fatal(got.UpcallPids)
+	}
+
+	for i := range expect {
+		if got.UpcallPids[i] != expect[i] {
+			t.Fatal(got.UpcallPids)
+		}
+	}
+}
+
+func TestVportUpcallPids(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	pids := []uint32{dpif.sock.Pid(), 1000, 1001}
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	vport, err := dp.CreateVportWithOptions(NewInternalVportSpec(name),
+		VportOptions{UpcallPids: pids})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkUpcallPids(vport, pids, t)
+
+	pids = []uint32{2000, 2001}
+	err = vport.SetUpcallPids(pids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkUpcallPids(vport, pids, t)
+
+	err = vport.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenUpcallSockets(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	vport, err := dp.CreateVport(NewInternalVportSpec(fmt.Sprintf("test%d", rand.Intn(100000))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vport.Delete()
+
+	us, err := dp.OpenUpcallSockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+
+	if !us.PerCPU {
+		// Fallen back to per-vport pids
+		checkUpcallPids(vport, us.Pids(), t)
+		return
+	}
+
+	opts, err := dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.UserFeatures&OVS_DP_F_DISPATCH_UPCALL_PER_CPU == 0 {
+		t.Fatal(opts.UserFeatures)
+	}
+
+	pids := us.Pids()
+	if len(opts.PerCPUUpcallPids) != len(pids) {
+		t.Fatal(opts.PerCPUUpcallPids)
+	}
+
+	for i := range pids {
+		if opts.PerCPUUpcallPids[i] != pids[i] {
+			t.Fatal(opts.PerCPUUpcallPids)
+		}
+	}
+}
+
+func TestCheckPerCPUUpcalls(t *testing.T) {
+	opts := DatapathOptions{PerCPUUpcallPids: []uint32{1000}}
+
+	// The kernel rejected the feature flag
+	err := checkPerCPUUpcalls(opts, datapathInfo{}, NetlinkError(syscall.EOPNOTSUPP))
+	if err != ErrNoPerCPUUpcalls {
+		t.Fatal(err)
+	}
+
+	// The kernel ignored the feature flag
+	dpi := datapathInfo{features: OVS_DP_F_UNALIGNED}
+	if err := checkPerCPUUpcalls(opts, dpi, nil); err != ErrNoPerCPUUpcalls {
+		t.Fatal(err)
+	}
+
+	// The kernel reported the feature flag, but not the pids
+	dpi.features |= OVS_DP_F_DISPATCH_UPCALL_PER_CPU
+	if err := checkPerCPUUpcalls(opts, dpi, nil); err != ErrNoPerCPUUpcalls {
+		t.Fatal(err)
+	}
+
+	// The kernel accepted it
+	dpi.perCPUUpcallPids = opts.PerCPUUpcallPids
+	if err := checkPerCPUUpcalls(opts, dpi, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other errors are passed through
+	err = checkPerCPUUpcalls(opts, datapathInfo{}, NetlinkError(syscall.EINVAL))
+	if !IsNetlinkError(err, syscall.EINVAL) {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for s, expect := range map[string]int{
+		"0":       1,
+		"0-7":     8,
+		"0,2-3":   4,
+		"0-3,8":   9,
+		"4-5,0-1": 6,
+	} {
+		n, err := parseCPUList(s)
+		if err != nil || n != expect {
+			t.Fatal(s, n, err)
+		}
+	}
+
+	for _, s := range []string{"", "0-", "3-1", "a", "0,,1"} {
+		if _, err := parseCPUList(s); err == nil {
+			t.Fatal(s)
+		}
+	}
+}
+
+func BenchmarkEnumerateFlows(b *testing.B) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dp.Delete()
+
+	vport, err := dp.CreateVport(NewInternalVportSpec(fmt.Sprintf("test%d", rand.Intn(100000))))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Enough flows that the dump spans many datagrams
+	const n = 2000
+	for i := 0; i < n; i++ {
+		flow := NewFlowSpec()
+		flow.AddKey(NewEthernetFlowKey(OvsKeyEthernet{
+			EthSrc: [...]byte{1, 2, 3, 4, byte(i >> 8), byte(i)},
+			EthDst: [...]byte{6, 5, 4, 3, 2, 1},
+		}, exactOvsKeyEthernetMask))
+		flow.AddAction(NewOutputAction(vport))
+		err = dp.CreateFlow(flow)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		flows, err := dp.EnumerateFlows()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(flows) != n {
+			b.Fatal(len(flows))
+		}
+	}
+}
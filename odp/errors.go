@@ -0,0 +1,180 @@
+package odp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Sentinel errors, for use with errors.Is.  Errors returned by
+// operations on a Dpif are usually *OpError values that wrap one of
+// these along with the underlying NetlinkError.
+var (
+	ErrModuleNotLoaded = errors.New("the Open vSwitch kernel module is probably not loaded")
+	ErrNotSupported    = errors.New("not supported by the Open vSwitch kernel module")
+	ErrNoSuchDatapath  = errors.New("no such datapath")
+	ErrDatapathExists  = errors.New("datapath already exists")
+	ErrNoSuchVport     = errors.New("no such vport")
+	ErrVportExists     = errors.New("vport already exists")
+	ErrPortNoInUse     = errors.New("port number already in use")
+	ErrNoSuchFlow      = errors.New("no such flow")
+	ErrFlowExists      = errors.New("flow already exists")
+	ErrNoSuchMeter     = errors.New("no such meter")
+
+	// The vport family reports ENODEV both when the vport does
+	// not exist and when its datapath does not, so such errors
+	// match ErrNoSuchVport and ErrNoSuchDatapath
+	ErrNoSuchVportOrDatapath error = &eitherKind{
+		msg:   "no such vport or datapath",
+		kinds: []error{ErrNoSuchVport, ErrNoSuchDatapath},
+	}
+
+	// Per-CPU upcall dispatch is not supported by the kernel
+	ErrNoPerCPUUpcalls = errors.New("per-CPU upcall dispatch not supported by the kernel")
+
+	// The kernel flagged a dump as interrupted by changes to the
+	// objects being dumped, so the results may not form a
+	// consistent snapshot.  Repeating the dump will usually
+	// succeed.
+	ErrDumpInterrupted = errors.New("netlink dump interrupted by concurrent changes")
+)
+
+// A sentinel error that stands for any of several others
+type eitherKind struct {
+	msg   string
+	kinds []error
+}
+
+func (k *eitherKind) Error() string {
+	return k.msg
+}
+
+func (k *eitherKind) Unwrap() []error {
+	return k.kinds
+}
+
+// An error from an operation on a Dpif
+type OpError struct {
+	// The operation, e.g. "create vport"
+	Op string
+
+	// The generic netlink family involved, e.g. "ovs_vport"
+	Family string
+
+	// The name of the datapath involved, if any and if known
+	Datapath string
+
+	// One of the sentinel errors above, or nil if the error
+	// was not classified
+	Kind error
+
+	// The underlying error, typically a NetlinkError.  May be
+	// nil if Kind says all there is to say.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	res := e.Op
+	if e.Datapath != "" {
+		res += fmt.Sprintf(" (datapath \"%s\")", e.Datapath)
+	}
+
+	if e.Kind != nil {
+		res += ": " + e.Kind.Error()
+	}
+
+	if e.Err != nil {
+		res += ": " + e.Err.Error()
+	}
+
+	return res
+}
+
+func (e *OpError) Unwrap() []error {
+	var res []error
+	if e.Kind != nil {
+		res = append(res, e.Kind)
+	}
+	if e.Err != nil {
+		res = append(res, e.Err)
+	}
+	return res
+}
+
+// Classify an error according to the family it came from
+func errorKind(family int, err error) error {
+	switch err {
+	case ErrNoPerCPUUpcalls, ErrDumpInterrupted, ErrNotSupported:
+		// Already a sentinel
+		return err
+	}
+
+	var nlerr NetlinkError
+	if !errors.As(err, &nlerr) {
+		return nil
+	}
+
+	switch syscall.Errno(nlerr) {
+	case syscall.ENODEV:
+		// The vport family also returns ENODEV when the
+		// datapath does not exist.
+		if family == VPORT {
+			return ErrNoSuchVportOrDatapath
+		}
+		return ErrNoSuchDatapath
+
+	case syscall.ENOENT:
+		switch family {
+		case FLOW:
+			return ErrNoSuchFlow
+		case METER:
+			return ErrNoSuchMeter
+		}
+
+	case syscall.EEXIST:
+		switch family {
+		case DATAPATH:
+			return ErrDatapathExists
+		case VPORT:
+			return ErrVportExists
+		case FLOW:
+			return ErrFlowExists
+		}
+
+	case syscall.EBUSY:
+		if family == VPORT {
+			return ErrPortNoInUse
+		}
+	}
+
+	return nil
+}
+
+func newOpError(op string, family int, dpname string, kind error, err error) error {
+	if kind == nil {
+		kind = errorKind(family, err)
+	}
+
+	if kind == err {
+		err = nil
+	}
+
+	return &OpError{
+		Op:       op,
+		Family:   familyNames[family],
+		Datapath: dpname,
+		Kind:     kind,
+		Err:      err,
+	}
+}
+
+// Do a request, wrapping any error in an OpError
+func (dpif *Dpif) request(ctx context.Context, op string, family int, dpname string, req *NlMsgBuilder) (*NlMsgParser, error) {
+	resp, err := dpif.sock.RequestContext(ctx, req)
+	if err != nil {
+		return nil, newOpError(op, family, dpname, nil, err)
+	}
+
+	return resp, nil
+}
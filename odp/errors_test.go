@@ -0,0 +1,44 @@
+package odp
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestOpError(t *testing.T) {
+	err := newOpError("delete vport", VPORT, "dp", nil, NetlinkExtendedError{NetlinkError: NetlinkError(syscall.ENODEV)})
+
+	if !errors.Is(err, ErrNoSuchVport) || !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+
+	// It might be the datapath that is missing
+	if !errors.Is(err, ErrNoSuchDatapath) || !IsNoSuchDatapathError(err) {
+		t.Fatal(err)
+	}
+
+	if errors.Is(err, ErrNoSuchFlow) {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(err, syscall.ENODEV) || !IsNetlinkError(err, syscall.ENODEV) {
+		t.Fatal(err)
+	}
+
+	var operr *OpError
+	if !errors.As(err, &operr) || operr.Datapath != "dp" || operr.Family != "ovs_vport" {
+		t.Fatal(err)
+	}
+
+	var nlerr NetlinkExtendedError
+	if !errors.As(err, &nlerr) {
+		t.Fatal(err)
+	}
+
+	// Sentinels are not repeated in the message
+	err = newOpError("enumerate flows", FLOW, "", nil, ErrDumpInterrupted)
+	if err.Error() != "enumerate flows: "+ErrDumpInterrupted.Error() {
+		t.Fatal(err)
+	}
+}
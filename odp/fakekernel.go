@@ -0,0 +1,1585 @@
+package odp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// A FakeKernel stands in for the Open vSwitch kernel module, by
+// implementing the ovs_datapath, ovs_vport, ovs_flow, ovs_packet,
+// ovs_meter and ovs_ct_limit generic netlink families in memory.  It
+// allows code that uses a Dpif to be tested without privileges or
+// the openvswitch module.  A Dpif still talks to it through a
+// NetlinkSocket, which wraps the FakeKernel's Transport, so the
+// same message encoding and parsing is exercised as with the kernel.
+//
+// It aims to follow the kernel's behaviour as seen over netlink,
+// including the error codes returned, the masking semantics of
+// flows, and dumps that are flagged as interrupted by concurrent
+// changes.  Like the kernel without NETLINK_CAP_ACK, error replies
+// include the whole request, and malformed attributes are reported
+// with extended ACK attributes identifying them.
+//
+// It does not process packets: ovs_packet execute requests are
+// checked but otherwise ignored, no upcalls are sent, and the
+// statistics of meters and conntrack zones are always zero.
+type FakeKernel struct {
+	lock        sync.Mutex
+	nextPid     uint32
+	nextIfIndex int32
+	datapaths   map[int32]*fakeDatapath
+
+	// Conntrack limits are per network namespace rather than per
+	// datapath.  Zones without an entry in ctLimits get
+	// ctDefaultLimit.  Zero means unlimited.
+	ctLimits       map[int32]uint32
+	ctDefaultLimit uint32
+
+	// Incremented on every change, so that dumps can tell if
+	// they were interrupted
+	generation uint64
+
+	// If set, called before producing each page of a dump after
+	// the first, without the lock held.  This lets tests make
+	// changes part way through a dump.  It must not make
+	// requests on the socket doing the dump.
+	dumpHook func()
+
+	// If set, called with each datagram sent to the FakeKernel
+	// before it is handled, without the lock held.  This lets
+	// tests make changes just before a particular request.  It
+	// must not make requests on the sending socket.
+	sendHook func(data []byte)
+
+	// The number of meters allowed on each datapath, which is
+	// also reported as OVS_METER_ATTR_MAX_METERS
+	maxMeters uint32
+}
+
+type fakeDatapath struct {
+	ifindex        int32
+	features       uint32
+	masksCacheSize uint32
+	perCPUPids     []uint32
+	vports         map[uint32]*fakeVport
+	meters         map[uint32]*fakeMeter
+
+	// In order of creation, which is the order they are dumped
+	flows []*fakeFlow
+}
+
+type fakeVport struct {
+	dp         *fakeDatapath
+	portNo     uint32
+	typ        uint32
+	name       string
+	options    []byte
+	upcallPids []uint32
+	ifindex    int32
+}
+
+type fakeMeter struct {
+	kbps  bool
+	bands []MeterBand
+}
+
+type fakeFlow struct {
+	// The flow key as given when the flow was created
+	key    Attrs
+	rawKey []byte
+
+	// nil if the flow is an exact match
+	mask    Attrs
+	rawMask []byte
+
+	actions []byte
+}
+
+// Generic netlink family ids used by the FakeKernel.  The kernel
+// allocates them dynamically, so nothing should depend on these.
+const fakeFamilyIdBase = 0x20
+
+// The families a FakeKernel supports
+var fakeFamilies = []int{DATAPATH, VPORT, FLOW, PACKET, METER, CT_LIMIT}
+
+// The number of messages in each datagram of a dump.  The kernel
+// fills datagrams by size rather than count, but this is enough to
+// make dumps of more than a few objects span several datagrams.
+const fakeDumpPageSize = 16
+
+// The user features the FakeKernel knows about
+const fakeDatapathFeatures = OVS_DP_F_UNALIGNED | OVS_DP_F_VPORT_PIDS |
+	OVS_DP_F_TC_RECIRC_SHARING | OVS_DP_F_DISPATCH_UPCALL_PER_CPU
+
+// The kernel's default size for a datapath's flow mask cache
+const fakeDefaultMasksCacheSize = 256
+
+// The maximum number of ports on a datapath
+const fakeMaxPorts = 65536
+
+// Network device names must fit in IFNAMSIZ bytes including the
+// terminating nul
+const fakeMaxNameLen = 15
+
+// The kernel limits the number of meters on a datapath according to
+// the memory available, and allows only one band per meter
+const (
+	fakeDefaultMaxMeters = 200000
+	fakeMaxBands         = 1
+)
+
+const (
+	sizeofOvsDpStats    = 32
+	sizeofOvsVportStats = 64
+)
+
+func NewFakeKernel() *FakeKernel {
+	return &FakeKernel{
+		nextPid:     1000,
+		nextIfIndex: 1000,
+		datapaths:   make(map[int32]*fakeDatapath),
+		ctLimits:    make(map[int32]uint32),
+		maxMeters:   fakeDefaultMaxMeters,
+	}
+}
+
+// Create a Transport connected to the FakeKernel, for use with
+// NewTransportNetlinkSocket.  Each Transport gets a distinct pid.
+func (k *FakeKernel) NewTransport() Transport {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.nextPid++
+	t := &fakeTransport{k: k, pid: k.nextPid}
+	t.cond.L = &k.lock
+	return t
+}
+
+// Create a Dpif connected to the FakeKernel.  Sockets it opens
+// later, e.g. by OpenUpcallSockets, are also connected to the
+// FakeKernel.
+func (k *FakeKernel) NewDpif() (*Dpif, error) {
+	dpif, err := NewDpifWithSocket(context.Background(), NewTransportNetlinkSocket(k.NewTransport()))
+	if err != nil {
+		return nil, err
+	}
+
+	dpif.openSocket = func() (*NetlinkSocket, error) {
+		return NewTransportNetlinkSocket(k.NewTransport()), nil
+	}
+	return dpif, nil
+}
+
+func (k *FakeKernel) changed() {
+	k.generation++
+}
+
+func (k *FakeKernel) allocIfIndex() int32 {
+	k.nextIfIndex++
+	return k.nextIfIndex
+}
+
+func (k *FakeKernel) findVportByName(name string) *fakeVport {
+	for _, dp := range k.datapaths {
+		for _, vport := range dp.vports {
+			if vport.name == name {
+				return vport
+			}
+		}
+	}
+
+	return nil
+}
+
+type fakeTransport struct {
+	k   *FakeKernel
+	pid uint32
+
+	// These are protected by the FakeKernel's lock
+	cond   sync.Cond
+	queue  [][]byte
+	dump   *fakeDump
+	closed bool
+}
+
+// A dump in progress.  Like the kernel, the FakeKernel produces the
+// pages of a dump as they are received.
+type fakeDump struct {
+	req         *fakeRequest
+	generation  uint64
+	pos         int
+	interrupted bool
+
+	// Produce messages for the objects from position pos
+	// onwards, returning whether there are more
+	page func(pos int, n int) ([]*NlMsgBuilder, bool, error)
+}
+
+func (t *fakeTransport) Send(data []byte) error {
+	k := t.k
+	k.lock.Lock()
+	hook := k.sendHook
+	k.lock.Unlock()
+	if hook != nil {
+		hook(data)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if t.closed {
+		return os.ErrClosed
+	}
+
+	// Attribute values are kept, so they must not alias the
+	// caller's buffer
+	msgs := &NlMsgParser{data: append([]byte(nil), data...)}
+	for {
+		msg, err := msgs.nextNlMsg()
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			break
+		}
+
+		t.handleRequest(msg)
+	}
+
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *fakeTransport) Receive() ([]byte, error) {
+	k := t.k
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	for {
+		if t.closed {
+			return nil, os.ErrClosed
+		}
+
+		if len(t.queue) > 0 {
+			data := t.queue[0]
+			t.queue = t.queue[1:]
+			return data, nil
+		}
+
+		if d := t.dump; d != nil {
+			if hook := k.dumpHook; hook != nil {
+				k.lock.Unlock()
+				hook()
+				k.lock.Lock()
+				if t.dump != d {
+					continue
+				}
+			}
+
+			t.dumpPage()
+			continue
+		}
+
+		t.cond.Wait()
+	}
+}
+
+func (t *fakeTransport) Pid() uint32 {
+	return t.pid
+}
+
+func (t *fakeTransport) Close() error {
+	t.k.lock.Lock()
+	defer t.k.lock.Unlock()
+
+	t.closed = true
+	t.queue = nil
+	t.dump = nil
+	t.cond.Broadcast()
+	return nil
+}
+
+// A request being handled by the FakeKernel
+type fakeRequest struct {
+	t       *fakeTransport
+	h       syscall.NlMsghdr
+	family  int
+	cmd     uint8
+	ifindex int32
+	attrs   Attrs
+
+	// The whole request message.  Attribute values are slices of
+	// it.
+	msg []byte
+}
+
+// An error concerning a particular request attribute, which the
+// kernel reports with extended ACK attributes
+type fakeAttrError struct {
+	errno syscall.Errno
+	msg   string
+
+	// The value of the attribute, or nil if it is missing
+	val []byte
+}
+
+func (err fakeAttrError) Error() string {
+	return err.msg
+}
+
+// The error from the kernel's netlink policy checks
+func fakePolicyError(errno syscall.Errno, val []byte) error {
+	return fakeAttrError{
+		errno: errno,
+		msg:   "Attribute failed policy validation",
+		val:   val,
+	}
+}
+
+// The minimum lengths of fixed size attributes, standing in for the
+// kernel's netlink policies
+var fakeAttrMinLens = [FAMILY_COUNT]map[uint16]int{
+	DATAPATH: {
+		OVS_DP_ATTR_UPCALL_PID:       4,
+		OVS_DP_ATTR_USER_FEATURES:    4,
+		OVS_DP_ATTR_MASKS_CACHE_SIZE: 4,
+	},
+	VPORT: {
+		OVS_VPORT_ATTR_PORT_NO: 4,
+		OVS_VPORT_ATTR_TYPE:    4,
+		OVS_VPORT_ATTR_IFINDEX: 4,
+	},
+	METER: {
+		OVS_METER_ATTR_ID:   4,
+		OVS_METER_ATTR_USED: 8,
+	},
+}
+
+func (t *fakeTransport) handleRequest(msg *NlMsgParser) {
+	r := &fakeRequest{
+		t:      t,
+		h:      *nlMsghdrAt(msg.data, msg.pos),
+		family: -1,
+		msg:    msg.data[msg.pos:],
+	}
+
+	err := r.parse(msg)
+	if err == nil {
+		err = r.handle()
+	}
+
+	if err != nil {
+		r.sendError(err)
+	} else if r.h.Flags&syscall.NLM_F_ACK != 0 && !r.isDump() {
+		r.sendError(nil)
+	}
+}
+
+func (r *fakeRequest) parse(msg *NlMsgParser) error {
+	if err := msg.Advance(syscall.SizeofNlMsghdr); err != nil {
+		return err
+	}
+
+	if r.h.Type != GENL_ID_CTRL {
+		for _, family := range fakeFamilies {
+			if r.h.Type == fakeFamilyIdBase+uint16(family) {
+				r.family = family
+			}
+		}
+
+		if r.family < 0 {
+			return syscall.ENOENT
+		}
+	}
+
+	pos, err := msg.AlignAdvance(syscall.NLMSG_ALIGNTO, SizeofGenlMsghdr)
+	if err != nil {
+		return err
+	}
+	r.cmd = genlMsghdrAt(msg.data, pos).Cmd
+
+	if r.family >= 0 {
+		ovshdr, err := msg.takeOvsHeader()
+		if err != nil {
+			return err
+		}
+		r.ifindex = ovshdr.DpIfIndex
+	}
+
+	r.attrs, err = msg.TakeAttrs()
+	if err != nil {
+		return err
+	}
+
+	if r.family >= 0 {
+		for typ, min := range fakeAttrMinLens[r.family] {
+			if val, ok := r.attrs[typ]; ok && len(val) < min {
+				return fakePolicyError(syscall.ERANGE, val)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *fakeRequest) handle() error {
+	k := r.t.k
+
+	if r.isDump() {
+		var page func(int, int) ([]*NlMsgBuilder, bool, error)
+		if r.cmd == OVS_DP_CMD_GET {
+			switch r.family {
+			case DATAPATH:
+				page = k.datapathPage(r)
+			case VPORT:
+				page = k.vportPage(r)
+			case FLOW:
+				page = k.flowPage(r)
+			}
+		}
+
+		if page == nil {
+			return syscall.EOPNOTSUPP
+		}
+
+		r.t.dump = &fakeDump{req: r, generation: k.generation, page: page}
+		r.t.dumpPage()
+		return nil
+	}
+
+	switch r.family {
+	case DATAPATH:
+		return k.datapathRequest(r)
+	case VPORT:
+		return k.vportRequest(r)
+	case FLOW:
+		return k.flowRequest(r)
+	case PACKET:
+		return k.packetRequest(r)
+	case METER:
+		return k.meterRequest(r)
+	case CT_LIMIT:
+		return k.ctLimitRequest(r)
+	default:
+		return k.ctrlRequest(r)
+	}
+}
+
+func (r *fakeRequest) isDump() bool {
+	return r.h.Flags&syscall.NLM_F_DUMP == syscall.NLM_F_DUMP
+}
+
+// Whether the requester wants to see the resulting object.  The
+// kernel always replies to a GET, and to other commands when
+// NLM_F_ECHO is set.  (The GET commands of all the OVS families have
+// the same value.)
+func (r *fakeRequest) wantsReply() bool {
+	return r.h.Flags&syscall.NLM_F_ECHO != 0 || r.cmd == OVS_DP_CMD_GET
+}
+
+var fakeFamilyVersions = [FAMILY_COUNT]uint8{
+	DATAPATH: OVS_DATAPATH_VERSION,
+	VPORT:    OVS_VPORT_VERSION,
+	FLOW:     OVS_FLOW_VERSION,
+	PACKET:   1,
+	METER:    OVS_METER_VERSION,
+	CT_LIMIT: OVS_CT_LIMIT_VERSION,
+}
+
+func (r *fakeRequest) newReply(cmd uint8, ifindex int32) *NlMsgBuilder {
+	b := NewNlMsgBuilder(0, fakeFamilyIdBase+uint16(r.family))
+	b.PutGenlMsghdr(cmd, fakeFamilyVersions[r.family])
+	b.putOvsHeader(ifindex)
+	return b
+}
+
+// Complete a reply message.  Unlike Finish, this does not allocate
+// a new sequence number.
+func (r *fakeRequest) finish(b *NlMsgBuilder, flags uint16) []byte {
+	h := nlMsghdrAt(b.buf, 0)
+	h.Len = uint32(len(b.buf))
+	h.Flags |= flags
+	h.Seq = r.h.Seq
+	h.Pid = r.t.pid
+	return b.buf
+}
+
+func (r *fakeRequest) send(b *NlMsgBuilder) {
+	r.t.queue = append(r.t.queue, r.finish(b, 0))
+}
+
+// Send an error, or an ack if err is nil.  As the kernel does
+// without NETLINK_CAP_ACK, an error includes the whole request, but
+// an ack only its header.
+func (r *fakeRequest) sendError(err error) {
+	var errno syscall.Errno
+	var attrErr fakeAttrError
+	if errors.As(err, &attrErr) {
+		errno = attrErr.errno
+	} else if err != nil {
+		var ok bool
+		if errno, ok = err.(syscall.Errno); !ok {
+			errno = syscall.EINVAL
+		}
+	}
+
+	flags := uint16(0)
+	if errno == 0 {
+		flags = NLM_F_CAPPED
+	}
+
+	b := NewNlMsgBuilder(flags, syscall.NLMSG_ERROR)
+	pos := b.Grow(syscall.SizeofNlMsgerr)
+	nlerr := nlMsgerrAt(b.buf, pos)
+	nlerr.Error = -int32(errno)
+	nlerr.Msg = r.h
+
+	if errno != 0 {
+		payload := r.msg[syscall.SizeofNlMsghdr:]
+		pos = b.Grow(uintptr(len(payload)))
+		copy(b.buf[pos:], payload)
+	}
+
+	if attrErr.msg != "" {
+		nlMsghdrAt(b.buf, 0).Flags |= NLM_F_ACK_TLVS
+		b.PutStringAttr(NLMSGERR_ATTR_MSG, attrErr.msg)
+		if offset, ok := r.attrOffset(attrErr.val); ok {
+			b.PutUint32Attr(NLMSGERR_ATTR_OFFS, offset)
+		}
+	}
+
+	r.send(b)
+}
+
+// Find the offset in the request of the attribute with the given
+// value.  The value is a slice of r.msg, so the difference in their
+// capacities gives its position.
+func (r *fakeRequest) attrOffset(val []byte) (uint32, bool) {
+	offset := cap(r.msg) - cap(val) - syscall.SizeofNlAttr
+	if val == nil || offset < syscall.SizeofNlMsghdr || offset >= len(r.msg) {
+		return 0, false
+	}
+
+	return uint32(offset), true
+}
+
+// Produce the next datagram of the dump
+func (t *fakeTransport) dumpPage() {
+	d := t.dump
+	r := d.req
+	msgs, more, err := d.page(d.pos, fakeDumpPageSize)
+	if err != nil {
+		t.dump = nil
+		r.sendError(err)
+		return
+	}
+
+	d.pos += len(msgs)
+	if t.k.generation != d.generation {
+		d.interrupted = true
+	}
+
+	flags := uint16(syscall.NLM_F_MULTI)
+	if d.interrupted {
+		flags |= NLM_F_DUMP_INTR
+	}
+
+	var data []byte
+	add := func(b *NlMsgBuilder) {
+		data = append(data[:align(len(data), syscall.NLMSG_ALIGNTO)], r.finish(b, flags)...)
+	}
+
+	for _, b := range msgs {
+		add(b)
+	}
+
+	if !more {
+		t.dump = nil
+		b := NewNlMsgBuilder(0, syscall.NLMSG_DONE)
+		b.Grow(4)
+		add(b)
+	}
+
+	t.queue = append(t.queue, data)
+}
+
+// Take the objects in [pos, pos+n) from a slice of length l,
+// returning the range and whether there are more.
+func fakePageRange(pos int, n int, l int) (int, int, bool) {
+	if pos > l {
+		pos = l
+	}
+
+	end := pos + n
+	if end >= l {
+		return pos, l, false
+	}
+
+	return pos, end, true
+}
+
+// The generic netlink controller
+
+func (k *FakeKernel) ctrlRequest(r *fakeRequest) error {
+	if r.cmd != CTRL_CMD_GETFAMILY {
+		return syscall.EOPNOTSUPP
+	}
+
+	name, err := r.attrs.GetString(CTRL_ATTR_FAMILY_NAME)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	for _, family := range fakeFamilies {
+		if familyNames[family] != name {
+			continue
+		}
+
+		b := NewNlMsgBuilder(0, GENL_ID_CTRL)
+		b.PutGenlMsghdr(CTRL_CMD_NEWFAMILY, 2)
+		b.PutUint16Attr(CTRL_ATTR_FAMILY_ID, fakeFamilyIdBase+uint16(family))
+		b.PutStringAttr(CTRL_ATTR_FAMILY_NAME, name)
+		b.PutUint32Attr(CTRL_ATTR_VERSION, uint32(fakeFamilyVersions[family]))
+		b.PutUint32Attr(CTRL_ATTR_HDRSIZE, SizeofOvsHeader)
+		r.send(b)
+		return nil
+	}
+
+	return syscall.ENOENT
+}
+
+// Datapaths
+
+func (dp *fakeDatapath) local() *fakeVport {
+	return dp.vports[OVSP_LOCAL]
+}
+
+func checkFakeName(attrs Attrs, typ uint16) (string, error) {
+	val, ok := attrs[typ]
+	if !ok {
+		return "", syscall.EINVAL
+	}
+
+	name, err := attrs.GetString(typ)
+	if err != nil || len(name) > fakeMaxNameLen {
+		return "", fakePolicyError(syscall.EINVAL, val)
+	}
+
+	return name, nil
+}
+
+// Find the datapath a request refers to, by name if given, and
+// otherwise by the ifindex in the ovs header
+func (k *FakeKernel) lookupDatapath(r *fakeRequest) (*fakeDatapath, error) {
+	if _, ok := r.attrs[OVS_DP_ATTR_NAME]; ok {
+		name, err := r.attrs.GetString(OVS_DP_ATTR_NAME)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+
+		vport := k.findVportByName(name)
+		if vport == nil || vport.portNo != OVSP_LOCAL {
+			return nil, syscall.ENODEV
+		}
+
+		return vport.dp, nil
+	}
+
+	dp := k.datapaths[r.ifindex]
+	if dp == nil {
+		return nil, syscall.ENODEV
+	}
+
+	return dp, nil
+}
+
+// Apply the options shared by OVS_DP_CMD_NEW and OVS_DP_CMD_SET
+func (dp *fakeDatapath) change(attrs Attrs) error {
+	features, _, err := attrs.GetOptionalUint32(OVS_DP_ATTR_USER_FEATURES)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	if features&^fakeDatapathFeatures != 0 {
+		return syscall.EOPNOTSUPP
+	}
+
+	size, haveSize, err := attrs.GetOptionalUint32(OVS_DP_ATTR_MASKS_CACHE_SIZE)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	if haveSize && size&(size-1) != 0 {
+		return syscall.EINVAL
+	}
+
+	pids, err := attrs.GetUint32Array(OVS_DP_ATTR_PER_CPU_PIDS, true)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	// Like the kernel, take a missing USER_FEATURES to mean no
+	// features
+	dp.features = features
+	if features&OVS_DP_F_DISPATCH_UPCALL_PER_CPU == 0 {
+		dp.perCPUPids = nil
+	}
+
+	if haveSize {
+		dp.masksCacheSize = size
+	}
+
+	if pids != nil && dp.features&OVS_DP_F_DISPATCH_UPCALL_PER_CPU != 0 {
+		dp.perCPUPids = pids
+	}
+
+	return nil
+}
+
+func (k *FakeKernel) datapathRequest(r *fakeRequest) error {
+	switch r.cmd {
+	case OVS_DP_CMD_NEW:
+		return k.newDatapath(r)
+
+	case OVS_DP_CMD_DEL:
+		dp, err := k.lookupDatapath(r)
+		if err != nil {
+			return err
+		}
+
+		delete(k.datapaths, dp.ifindex)
+		k.changed()
+		if r.wantsReply() {
+			r.send(r.datapathReply(OVS_DP_CMD_DEL, dp))
+		}
+		return nil
+
+	case OVS_DP_CMD_GET:
+		dp, err := k.lookupDatapath(r)
+		if err != nil {
+			return err
+		}
+
+		r.send(r.datapathReply(OVS_DP_CMD_NEW, dp))
+		return nil
+
+	case OVS_DP_CMD_SET:
+		dp, err := k.lookupDatapath(r)
+		if err != nil {
+			return err
+		}
+
+		if err := dp.change(r.attrs); err != nil {
+			return err
+		}
+
+		k.changed()
+		if r.wantsReply() {
+			r.send(r.datapathReply(OVS_DP_CMD_NEW, dp))
+		}
+		return nil
+	}
+
+	return syscall.EOPNOTSUPP
+}
+
+func (k *FakeKernel) newDatapath(r *fakeRequest) error {
+	name, err := checkFakeName(r.attrs, OVS_DP_ATTR_NAME)
+	if err != nil {
+		return err
+	}
+
+	pids, err := r.attrs.GetUint32Array(OVS_DP_ATTR_UPCALL_PID, false)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	if k.findVportByName(name) != nil {
+		return syscall.EEXIST
+	}
+
+	dp := &fakeDatapath{
+		ifindex:        k.allocIfIndex(),
+		masksCacheSize: fakeDefaultMasksCacheSize,
+		vports:         make(map[uint32]*fakeVport),
+		meters:         make(map[uint32]*fakeMeter),
+	}
+
+	if err := dp.change(r.attrs); err != nil {
+		return err
+	}
+
+	// The datapath's local port is a network device with the
+	// same name and ifindex as the datapath
+	dp.vports[OVSP_LOCAL] = &fakeVport{
+		dp:         dp,
+		portNo:     OVSP_LOCAL,
+		typ:        OVS_VPORT_TYPE_INTERNAL,
+		name:       name,
+		upcallPids: pids,
+		ifindex:    dp.ifindex,
+	}
+
+	k.datapaths[dp.ifindex] = dp
+	k.changed()
+	if r.wantsReply() {
+		r.send(r.datapathReply(OVS_DP_CMD_NEW, dp))
+	}
+	return nil
+}
+
+func (r *fakeRequest) datapathReply(cmd uint8, dp *fakeDatapath) *NlMsgBuilder {
+	b := r.newReply(cmd, dp.ifindex)
+	b.PutStringAttr(OVS_DP_ATTR_NAME, dp.local().name)
+
+	var stats [sizeofOvsDpStats]byte
+	*uint64At(stats[:], 24) = uint64(len(dp.flows))
+	b.PutSliceAttr(OVS_DP_ATTR_STATS, stats[:])
+
+	b.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, dp.features)
+	b.PutUint32Attr(OVS_DP_ATTR_MASKS_CACHE_SIZE, dp.masksCacheSize)
+
+	if len(dp.perCPUPids) > 0 {
+		b.PutUint32ArrayAttr(OVS_DP_ATTR_PER_CPU_PIDS, dp.perCPUPids)
+	}
+
+	return b
+}
+
+func (k *FakeKernel) datapathPage(r *fakeRequest) func(int, int) ([]*NlMsgBuilder, bool, error) {
+	return func(pos int, n int) ([]*NlMsgBuilder, bool, error) {
+		ifindexes := make([]int, 0, len(k.datapaths))
+		for ifindex := range k.datapaths {
+			ifindexes = append(ifindexes, int(ifindex))
+		}
+		sort.Ints(ifindexes)
+
+		start, end, more := fakePageRange(pos, n, len(ifindexes))
+		var msgs []*NlMsgBuilder
+		for _, ifindex := range ifindexes[start:end] {
+			msgs = append(msgs, r.datapathReply(OVS_DP_CMD_NEW, k.datapaths[int32(ifindex)]))
+		}
+
+		return msgs, more, nil
+	}
+}
+
+// Vports
+
+// Find the vport a request refers to, by name if given, and
+// otherwise by port number
+func (k *FakeKernel) lookupVport(r *fakeRequest) (*fakeVport, error) {
+	if _, ok := r.attrs[OVS_VPORT_ATTR_NAME]; ok {
+		name, err := r.attrs.GetString(OVS_VPORT_ATTR_NAME)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+
+		vport := k.findVportByName(name)
+		if vport == nil || (r.ifindex != 0 && r.ifindex != vport.dp.ifindex) {
+			return nil, syscall.ENODEV
+		}
+
+		return vport, nil
+	}
+
+	portNo, ok, err := r.attrs.GetOptionalUint32(OVS_VPORT_ATTR_PORT_NO)
+	if err != nil || !ok {
+		return nil, syscall.EINVAL
+	}
+
+	if portNo >= fakeMaxPorts {
+		return nil, syscall.EFBIG
+	}
+
+	dp := k.datapaths[r.ifindex]
+	if dp == nil {
+		return nil, syscall.ENODEV
+	}
+
+	vport := dp.vports[portNo]
+	if vport == nil {
+		return nil, syscall.ENODEV
+	}
+
+	return vport, nil
+}
+
+func (k *FakeKernel) vportRequest(r *fakeRequest) error {
+	switch r.cmd {
+	case OVS_VPORT_CMD_NEW:
+		return k.newVport(r)
+
+	case OVS_VPORT_CMD_DEL:
+		vport, err := k.lookupVport(r)
+		if err != nil {
+			return err
+		}
+
+		if vport.portNo == OVSP_LOCAL {
+			return syscall.EINVAL
+		}
+
+		delete(vport.dp.vports, vport.portNo)
+		k.changed()
+		if r.wantsReply() {
+			r.send(r.vportReply(OVS_VPORT_CMD_DEL, vport))
+		}
+		return nil
+
+	case OVS_VPORT_CMD_GET:
+		vport, err := k.lookupVport(r)
+		if err != nil {
+			return err
+		}
+
+		r.send(r.vportReply(OVS_VPORT_CMD_NEW, vport))
+		return nil
+
+	case OVS_VPORT_CMD_SET:
+		vport, err := k.lookupVport(r)
+		if err != nil {
+			return err
+		}
+
+		typ, ok, err := r.attrs.GetOptionalUint32(OVS_VPORT_ATTR_TYPE)
+		if err != nil || (ok && typ != vport.typ) {
+			return syscall.EINVAL
+		}
+
+		pids, err := r.attrs.GetUint32Array(OVS_VPORT_ATTR_UPCALL_PID, true)
+		if err != nil {
+			return syscall.EINVAL
+		}
+
+		if options, ok := r.attrs[OVS_VPORT_ATTR_OPTIONS]; ok {
+			vport.options = options
+		}
+
+		if pids != nil {
+			vport.upcallPids = pids
+		}
+
+		k.changed()
+		if r.wantsReply() {
+			r.send(r.vportReply(OVS_VPORT_CMD_NEW, vport))
+		}
+		return nil
+	}
+
+	return syscall.EOPNOTSUPP
+}
+
+func (k *FakeKernel) newVport(r *fakeRequest) error {
+	name, err := checkFakeName(r.attrs, OVS_VPORT_ATTR_NAME)
+	if err != nil {
+		return err
+	}
+
+	typ, err := r.attrs.GetUint32(OVS_VPORT_ATTR_TYPE)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	pids, err := r.attrs.GetUint32Array(OVS_VPORT_ATTR_UPCALL_PID, false)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	portNo, havePortNo, err := r.attrs.GetOptionalUint32(OVS_VPORT_ATTR_PORT_NO)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	dp := k.datapaths[r.ifindex]
+	if dp == nil {
+		return syscall.ENODEV
+	}
+
+	if havePortNo {
+		if portNo >= fakeMaxPorts {
+			return syscall.EFBIG
+		}
+
+		if dp.vports[portNo] != nil {
+			return syscall.EBUSY
+		}
+	} else {
+		for portNo = 1; dp.vports[portNo] != nil; portNo++ {
+			if portNo >= fakeMaxPorts {
+				return syscall.EFBIG
+			}
+		}
+	}
+
+	if k.findVportByName(name) != nil {
+		return syscall.EEXIST
+	}
+
+	vport := &fakeVport{
+		dp:         dp,
+		portNo:     portNo,
+		typ:        typ,
+		name:       name,
+		options:    r.attrs[OVS_VPORT_ATTR_OPTIONS],
+		upcallPids: pids,
+		ifindex:    k.allocIfIndex(),
+	}
+
+	dp.vports[portNo] = vport
+	k.changed()
+	if r.wantsReply() {
+		r.send(r.vportReply(OVS_VPORT_CMD_NEW, vport))
+	}
+	return nil
+}
+
+func (r *fakeRequest) vportReply(cmd uint8, vport *fakeVport) *NlMsgBuilder {
+	b := r.newReply(cmd, vport.dp.ifindex)
+	b.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, vport.portNo)
+	b.PutUint32Attr(OVS_VPORT_ATTR_TYPE, vport.typ)
+	b.PutStringAttr(OVS_VPORT_ATTR_NAME, vport.name)
+	b.PutUint32ArrayAttr(OVS_VPORT_ATTR_UPCALL_PID, vport.upcallPids)
+
+	var stats [sizeofOvsVportStats]byte
+	b.PutSliceAttr(OVS_VPORT_ATTR_STATS, stats[:])
+
+	if len(vport.options) > 0 {
+		b.PutSliceAttr(OVS_VPORT_ATTR_OPTIONS, vport.options)
+	}
+
+	b.PutUint32Attr(OVS_VPORT_ATTR_IFINDEX, uint32(vport.ifindex))
+	return b
+}
+
+func (k *FakeKernel) vportPage(r *fakeRequest) func(int, int) ([]*NlMsgBuilder, bool, error) {
+	return func(pos int, n int) ([]*NlMsgBuilder, bool, error) {
+		dp := k.datapaths[r.ifindex]
+		if dp == nil {
+			return nil, false, syscall.ENODEV
+		}
+
+		portNos := make([]int, 0, len(dp.vports))
+		for portNo := range dp.vports {
+			portNos = append(portNos, int(portNo))
+		}
+		sort.Ints(portNos)
+
+		start, end, more := fakePageRange(pos, n, len(portNos))
+		var msgs []*NlMsgBuilder
+		for _, portNo := range portNos[start:end] {
+			msgs = append(msgs, r.vportReply(OVS_VPORT_CMD_NEW, dp.vports[uint32(portNo)]))
+		}
+
+		return msgs, more, nil
+	}
+}
+
+// Flows
+//
+// A flow matches a packet if the packet's key, masked by the flow's
+// mask, equals the flow's key masked in the same way.  Flow keys
+// are handled as opaque attribute values, except that masks are
+// applied bytewise to values that have the same length as the
+// mask.  (Nested keys such as OVS_KEY_ATTR_TUNNEL are compared
+// whole unless their mask is all zeros.)
+
+// Mask a flow key.  A nil mask means an exact match.  Values that
+// end up all zeros are omitted, so that they compare equal to
+// absent ones.
+func maskFlowKey(key Attrs, mask Attrs) Attrs {
+	if mask == nil {
+		return key
+	}
+
+	res := make(Attrs)
+	for typ, val := range key {
+		m, ok := mask[typ]
+		if !ok || AllBytes(m, 0) {
+			continue
+		}
+
+		if len(m) == len(val) {
+			masked := make([]byte, len(val))
+			for i := range val {
+				masked[i] = val[i] & m[i]
+			}
+			val = masked
+		}
+
+		if !AllBytes(val, 0) {
+			res[typ] = val
+		}
+	}
+
+	return res
+}
+
+func flowKeysEqual(a Attrs, b Attrs) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for typ, aval := range a {
+		bval, ok := b[typ]
+		if !ok || !bytes.Equal(aval, bval) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Find a flow that would match packets with the given (masked) key
+func (dp *fakeDatapath) lookupFlow(key Attrs) *fakeFlow {
+	for _, f := range dp.flows {
+		if flowKeysEqual(maskFlowKey(key, f.mask), maskFlowKey(f.key, f.mask)) {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// Find the flow with exactly the given unmasked key
+func (dp *fakeDatapath) lookupFlowExact(key Attrs) *fakeFlow {
+	for _, f := range dp.flows {
+		if flowKeysEqual(key, f.key) {
+			return f
+		}
+	}
+
+	return nil
+}
+
+func (dp *fakeDatapath) deleteFlow(f *fakeFlow) {
+	for i, g := range dp.flows {
+		if g == f {
+			dp.flows = append(dp.flows[:i:i], dp.flows[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get the key from a flow request
+func flowRequestKey(attrs Attrs) (Attrs, []byte, error) {
+	raw, ok := attrs[OVS_FLOW_ATTR_KEY]
+	if !ok {
+		return nil, nil, syscall.EINVAL
+	}
+
+	key, err := ParseNestedAttrs(raw)
+	if err != nil {
+		return nil, nil, syscall.EINVAL
+	}
+
+	return key, raw, nil
+}
+
+func (k *FakeKernel) flowRequest(r *fakeRequest) error {
+	dp := k.datapaths[r.ifindex]
+	if dp == nil {
+		return syscall.ENODEV
+	}
+
+	switch r.cmd {
+	case OVS_FLOW_CMD_NEW:
+		return k.newFlow(r, dp)
+
+	case OVS_FLOW_CMD_DEL:
+		if _, ok := r.attrs[OVS_FLOW_ATTR_KEY]; !ok {
+			// Delete all flows
+			dp.flows = nil
+			k.changed()
+			return nil
+		}
+
+		key, _, err := flowRequestKey(r.attrs)
+		if err != nil {
+			return err
+		}
+
+		f := dp.lookupFlowExact(key)
+		if f == nil {
+			return syscall.ENOENT
+		}
+
+		dp.deleteFlow(f)
+		k.changed()
+		if r.wantsReply() {
+			r.send(r.flowReply(OVS_FLOW_CMD_DEL, dp, f))
+		}
+		return nil
+
+	case OVS_FLOW_CMD_GET, OVS_FLOW_CMD_SET:
+		key, _, err := flowRequestKey(r.attrs)
+		if err != nil {
+			return err
+		}
+
+		f := dp.lookupFlowExact(key)
+		if f == nil {
+			return syscall.ENOENT
+		}
+
+		if r.cmd == OVS_FLOW_CMD_SET {
+			if actions, ok := r.attrs[OVS_FLOW_ATTR_ACTIONS]; ok {
+				if _, err := ParseOrderedAttrs(actions); err != nil {
+					return syscall.EINVAL
+				}
+
+				f.actions = actions
+				k.changed()
+			}
+		}
+
+		if r.wantsReply() {
+			r.send(r.flowReply(OVS_FLOW_CMD_NEW, dp, f))
+		}
+		return nil
+	}
+
+	return syscall.EOPNOTSUPP
+}
+
+func (k *FakeKernel) newFlow(r *fakeRequest, dp *fakeDatapath) error {
+	key, rawKey, err := flowRequestKey(r.attrs)
+	if err != nil {
+		return err
+	}
+
+	var mask Attrs
+	rawMask, haveMask := r.attrs[OVS_FLOW_ATTR_MASK]
+	if haveMask {
+		mask, err = ParseNestedAttrs(rawMask)
+		if err != nil {
+			return syscall.EINVAL
+		}
+	}
+
+	actions, ok := r.attrs[OVS_FLOW_ATTR_ACTIONS]
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	if _, err := ParseOrderedAttrs(actions); err != nil {
+		return syscall.EINVAL
+	}
+
+	f := dp.lookupFlow(maskFlowKey(key, mask))
+	if f == nil {
+		f = &fakeFlow{
+			key:     key,
+			rawKey:  rawKey,
+			mask:    mask,
+			rawMask: rawMask,
+			actions: actions,
+		}
+		dp.flows = append(dp.flows, f)
+	} else {
+		// An overlapping flow exists.  It can only be
+		// updated if it has the same key.
+		if r.h.Flags&(syscall.NLM_F_CREATE|syscall.NLM_F_EXCL) != 0 {
+			return syscall.EEXIST
+		}
+
+		if !flowKeysEqual(key, f.key) {
+			f = dp.lookupFlowExact(key)
+			if f == nil {
+				return syscall.ENOENT
+			}
+		}
+
+		f.actions = actions
+	}
+
+	k.changed()
+	if r.wantsReply() {
+		r.send(r.flowReply(OVS_FLOW_CMD_NEW, dp, f))
+	}
+	return nil
+}
+
+func (r *fakeRequest) flowReply(cmd uint8, dp *fakeDatapath, f *fakeFlow) *NlMsgBuilder {
+	b := r.newReply(cmd, dp.ifindex)
+	b.PutSliceAttr(OVS_FLOW_ATTR_KEY, f.rawKey)
+
+	// Like the kernel, omit the mask of an exact match flow
+	if f.mask != nil {
+		b.PutSliceAttr(OVS_FLOW_ATTR_MASK, f.rawMask)
+	}
+
+	b.PutSliceAttr(OVS_FLOW_ATTR_ACTIONS, f.actions)
+	return b
+}
+
+func (k *FakeKernel) flowPage(r *fakeRequest) func(int, int) ([]*NlMsgBuilder, bool, error) {
+	return func(pos int, n int) ([]*NlMsgBuilder, bool, error) {
+		dp := k.datapaths[r.ifindex]
+		if dp == nil {
+			return nil, false, syscall.ENODEV
+		}
+
+		start, end, more := fakePageRange(pos, n, len(dp.flows))
+		var msgs []*NlMsgBuilder
+		for _, f := range dp.flows[start:end] {
+			msgs = append(msgs, r.flowReply(OVS_FLOW_CMD_NEW, dp, f))
+		}
+
+		return msgs, more, nil
+	}
+}
+
+// Packets
+
+func (k *FakeKernel) packetRequest(r *fakeRequest) error {
+	if r.cmd != OVS_PACKET_CMD_EXECUTE {
+		return syscall.EOPNOTSUPP
+	}
+
+	for _, typ := range []uint16{OVS_PACKET_ATTR_PACKET, OVS_PACKET_ATTR_KEY, OVS_PACKET_ATTR_ACTIONS} {
+		if _, ok := r.attrs[typ]; !ok {
+			return syscall.EINVAL
+		}
+	}
+
+	if _, err := ParseOrderedAttrs(r.attrs[OVS_PACKET_ATTR_ACTIONS]); err != nil {
+		return syscall.EINVAL
+	}
+
+	if k.datapaths[r.ifindex] == nil {
+		return syscall.ENODEV
+	}
+
+	// The packet goes nowhere
+	return nil
+}
+
+// Meters
+
+func (k *FakeKernel) meterRequest(r *fakeRequest) error {
+	dp := k.datapaths[r.ifindex]
+	if dp == nil {
+		return syscall.ENODEV
+	}
+
+	if r.cmd == OVS_METER_CMD_FEATURES {
+		b := r.newReply(OVS_METER_CMD_FEATURES, r.ifindex)
+		b.PutUint32Attr(OVS_METER_ATTR_MAX_METERS, k.maxMeters)
+		b.PutUint32Attr(OVS_METER_ATTR_MAX_BANDS, fakeMaxBands)
+		b.PutNestedAttrs(OVS_METER_ATTR_BANDS, func() {
+			b.PutNestedAttrs(OVS_BAND_ATTR_UNSPEC, func() {
+				b.PutUint32Attr(OVS_BAND_ATTR_TYPE, OVS_METER_BAND_TYPE_DROP)
+			})
+		})
+		r.send(b)
+		return nil
+	}
+
+	id, err := r.attrs.GetUint32(OVS_METER_ATTR_ID)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	old := dp.meters[id]
+	switch r.cmd {
+	case OVS_METER_CMD_SET:
+		m, err := newFakeMeter(r.attrs)
+		if err != nil {
+			return err
+		}
+
+		// The kernel limits the number of meters, not their ids
+		if old == nil && uint32(len(dp.meters)) >= k.maxMeters {
+			return syscall.EFBIG
+		}
+
+		dp.meters[id] = m
+
+		// The reply carries the stats of the meter replaced,
+		// if any
+		r.send(r.meterReply(OVS_METER_CMD_SET, id, old))
+		return nil
+
+	case OVS_METER_CMD_DEL:
+		// Deleting a meter that does not exist succeeds, with
+		// an empty reply
+		if old == nil {
+			r.send(r.newReply(OVS_METER_CMD_DEL, r.ifindex))
+			return nil
+		}
+
+		delete(dp.meters, id)
+		r.send(r.meterReply(OVS_METER_CMD_DEL, id, old))
+		return nil
+
+	case OVS_METER_CMD_GET:
+		if old == nil {
+			return syscall.ENOENT
+		}
+
+		r.send(r.meterReply(OVS_METER_CMD_GET, id, old))
+		return nil
+	}
+
+	return syscall.EOPNOTSUPP
+}
+
+func newFakeMeter(attrs Attrs) (*fakeMeter, error) {
+	kbps, err := attrs.GetEmpty(OVS_METER_ATTR_KBPS)
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+
+	var bands []Attr
+	if _, ok := attrs[OVS_METER_ATTR_BANDS]; ok {
+		bands, err = attrs.GetOrderedAttrs(OVS_METER_ATTR_BANDS)
+		if err != nil || len(bands) > fakeMaxBands {
+			return nil, syscall.EINVAL
+		}
+	}
+
+	m := &fakeMeter{kbps: kbps}
+	for _, a := range bands {
+		band, err := ParseNestedAttrs(a.val)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+
+		// Only drop bands with a non-zero rate are supported
+		typ, _, err := band.GetOptionalUint32(OVS_BAND_ATTR_TYPE)
+		if err != nil || typ != OVS_METER_BAND_TYPE_DROP {
+			return nil, syscall.EINVAL
+		}
+
+		rate, _, err := band.GetOptionalUint32(OVS_BAND_ATTR_RATE)
+		if err != nil || rate == 0 {
+			return nil, syscall.EINVAL
+		}
+
+		burst, _, err := band.GetOptionalUint32(OVS_BAND_ATTR_BURST)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+
+		m.bands = append(m.bands, MeterBand{Type: typ, Rate: rate, Burst: burst})
+	}
+
+	return m, nil
+}
+
+func (r *fakeRequest) meterReply(cmd uint8, id uint32, m *fakeMeter) *NlMsgBuilder {
+	b := r.newReply(cmd, r.ifindex)
+	b.PutUint32Attr(OVS_METER_ATTR_ID, id)
+	if m == nil {
+		return b
+	}
+
+	var stats [SizeofOvsFlowStats]byte
+	b.PutSliceAttr(OVS_METER_ATTR_STATS, stats[:])
+
+	var used [8]byte
+	b.PutSliceAttr(OVS_METER_ATTR_USED, used[:])
+
+	b.PutNestedAttrs(OVS_METER_ATTR_BANDS, func() {
+		for range m.bands {
+			b.PutNestedAttrs(OVS_BAND_ATTR_UNSPEC, func() {
+				b.PutSliceAttr(OVS_BAND_ATTR_STATS, stats[:])
+			})
+		}
+	})
+
+	return b
+}
+
+// Conntrack limits
+
+// Conntrack zone ids are 16 bits
+func fakeZoneInRange(zone int32) bool {
+	return zone >= 0 && zone <= 0xffff
+}
+
+func (k *FakeKernel) ctLimit(zone int32) uint32 {
+	if limit, ok := k.ctLimits[zone]; ok {
+		return limit
+	}
+
+	return k.ctDefaultLimit
+}
+
+func (k *FakeKernel) ctLimitRequest(r *fakeRequest) error {
+	data, haveLimits := r.attrs[OVS_CT_LIMIT_ATTR_ZONE_LIMIT]
+	if !haveLimits && r.cmd != OVS_CT_LIMIT_CMD_GET {
+		return syscall.EINVAL
+	}
+
+	// Like the kernel, ignore any trailing partial entry, and
+	// zones that are out of range
+	var limits []OvsZoneLimit
+	for pos := 0; pos+SizeofOvsZoneLimit <= len(data); pos += SizeofOvsZoneLimit {
+		limit := *ovsZoneLimitAt(data, pos)
+		if limit.ZoneId == OVS_ZONE_LIMIT_DEFAULT_ZONE || fakeZoneInRange(limit.ZoneId) {
+			limits = append(limits, limit)
+		}
+	}
+
+	switch r.cmd {
+	case OVS_CT_LIMIT_CMD_SET:
+		for _, limit := range limits {
+			if limit.ZoneId == OVS_ZONE_LIMIT_DEFAULT_ZONE {
+				k.ctDefaultLimit = limit.Limit
+			} else {
+				k.ctLimits[limit.ZoneId] = limit.Limit
+			}
+		}
+
+	case OVS_CT_LIMIT_CMD_DEL:
+		for _, limit := range limits {
+			if limit.ZoneId == OVS_ZONE_LIMIT_DEFAULT_ZONE {
+				k.ctDefaultLimit = 0
+			} else {
+				delete(k.ctLimits, limit.ZoneId)
+			}
+		}
+
+	case OVS_CT_LIMIT_CMD_GET:
+		// Without a list of zones, the default limit comes
+		// first, followed by the zones with limits
+		if !haveLimits {
+			limits = []OvsZoneLimit{{ZoneId: OVS_ZONE_LIMIT_DEFAULT_ZONE}}
+			zones := make([]int, 0, len(k.ctLimits))
+			for zone := range k.ctLimits {
+				zones = append(zones, int(zone))
+			}
+			sort.Ints(zones)
+
+			for _, zone := range zones {
+				limits = append(limits, OvsZoneLimit{ZoneId: int32(zone)})
+			}
+		}
+
+		b := r.newReply(OVS_CT_LIMIT_CMD_GET, 0)
+		b.PutAttr(OVS_CT_LIMIT_ATTR_ZONE_LIMIT, func() {
+			for _, limit := range limits {
+				pos := b.Grow(SizeofOvsZoneLimit)
+				*ovsZoneLimitAt(b.buf, pos) = OvsZoneLimit{
+					ZoneId: limit.ZoneId,
+					Limit:  k.ctLimit(limit.ZoneId),
+				}
+			}
+		})
+		r.send(b)
+		return nil
+
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	r.send(r.newReply(r.cmd, 0))
+	return nil
+}
@@ -0,0 +1,190 @@
+package odp
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestFakeKernelDumpInterrupted(t *testing.T) {
+	k := NewFakeKernel()
+	dpif, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dpif2, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif2, t)
+
+	dp, err := dpif.CreateDatapath("dumpintr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough vports that the dump spans several datagrams
+	const n = 3 * fakeDumpPageSize
+	for i := 0; i < n; i++ {
+		_, err := dp.CreateVport(NewInternalVportSpec(fmt.Sprintf("dumpintr%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete a vport part way through the dump, so that it skips
+	// a later one
+	dp2 := dpif2.NewDatapathHandle(dp.IfIndex(), dp.Name())
+	var toDelete []uint32
+	k.lock.Lock()
+	k.dumpHook = func() {
+		if len(toDelete) > 0 {
+			if err := dp2.NewVportHandle(toDelete[0]).Delete(); err != nil {
+				t.Error(err)
+			}
+			toDelete = toDelete[1:]
+		}
+	}
+	k.lock.Unlock()
+
+	toDelete = []uint32{1}
+	vports, err := dp.EnumerateVports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retried dump is complete
+	if len(vports) != n {
+		t.Fatal(len(vports))
+	}
+
+	for i, vport := range vports {
+		if i > 0 && vport.Handle.PortNo() != uint32(i+1) {
+			t.Fatal(vport.Handle.PortNo())
+		}
+	}
+
+	toDelete = []uint32{2}
+	dpif.SetDumpRetries(0)
+	_, err = dp.EnumerateVports()
+	if !errors.Is(err, ErrDumpInterrupted) {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeKernelOverlappingFlows(t *testing.T) {
+	k := NewFakeKernel()
+	dpif, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath("overlap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vport, err := dp.CreateVport(NewInternalVportSpec("overlap1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFlow := func(dst byte, mask OvsKeyEthernet, port uint32) FlowSpec {
+		f := NewFlowSpec()
+		f.AddKey(NewEthernetFlowKey(OvsKeyEthernet{
+			EthSrc: [...]byte{1, 2, 3, 4, 5, 6},
+			EthDst: [...]byte{6, 5, 4, 3, 2, dst},
+		}, mask))
+		f.AddAction(NewOutputAction(dp.NewVportHandle(port)))
+		return f
+	}
+
+	// Match on the source address only
+	srcMask := OvsKeyEthernet{EthSrc: exactOvsKeyEthernetMask.EthSrc}
+	if err := dp.CreateFlow(newFlow(1, srcMask, vport.PortNo())); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flow with a different key that overlaps it cannot be
+	// created
+	err = dp.CreateFlow(newFlow(2, exactOvsKeyEthernetMask, vport.PortNo()))
+	if !errors.Is(err, ErrNoSuchFlow) {
+		t.Fatal(err)
+	}
+
+	// But the same key updates the actions
+	updated := newFlow(1, srcMask, OVSP_LOCAL)
+	if err := dp.CreateFlow(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	flows, err := dp.EnumerateFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(flows) != 1 || !flows[0].Equals(updated) {
+		t.Fatal(flows)
+	}
+}
+
+func TestFakeKernelExtendedAck(t *testing.T) {
+	k := NewFakeKernel()
+	dpif, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	// The name is longer than IFNAMSIZ allows
+	_, err = dpif.CreateDatapath("extackextackextack")
+	var nlerr NetlinkExtendedError
+	if !errors.As(err, &nlerr) {
+		t.Fatal(err)
+	}
+
+	if !IsNetlinkError(err, syscall.EINVAL) || nlerr.Msg == "" {
+		t.Fatal(err)
+	}
+
+	if len(nlerr.AttrPath) != 1 || nlerr.AttrPath[0] != OVS_DP_ATTR_NAME {
+		t.Fatal(nlerr.AttrPath)
+	}
+}
+
+func TestFakeKernelSetWithoutFeatures(t *testing.T) {
+	k := NewFakeKernel()
+	dpif, err := k.NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath("nofeatures")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the kernel, an OVS_DP_CMD_SET without USER_FEATURES
+	// clears them
+	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[DATAPATH])
+	req.PutGenlMsghdr(OVS_DP_CMD_SET, OVS_DATAPATH_VERSION)
+	req.putOvsHeader(dp.IfIndex())
+	req.PutUint32Attr(OVS_DP_ATTR_MASKS_CACHE_SIZE, 512)
+	if _, err := dpif.sock.Request(req); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := dp.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.UserFeatures != 0 || opts.MasksCacheSize != 512 {
+		t.Fatal(opts)
+	}
+}
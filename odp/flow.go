@@ -1,8 +1,10 @@
 package odp
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"syscall"
+	"sort"
 )
 
 func AllBytes(data []byte, x byte) bool {
@@ -74,7 +76,7 @@ func parseFlowKeys(keys Attrs, masks Attrs, parsers FlowKeyParsers) (res FlowKey
 	for typ, key := range keys {
 		parser, ok := parsers[typ]
 		if !ok {
-			return nil, fmt.Errorf("unknown flow key type %d (value %v)", typ, key)
+			parser = rawFlowKeyParser(len(key))
 		}
 
 		var mask []byte
@@ -108,7 +110,7 @@ func parseFlowKeys(keys Attrs, masks Attrs, parsers FlowKeyParsers) (res FlowKey
 			// key value
 			parser, ok := parsers[typ]
 			if !ok {
-				return nil, fmt.Errorf("unknown flow key type %d (mask %v)", typ, mask)
+				parser = rawFlowKeyParser(len(mask))
 			}
 
 			res[typ], err = parser.parse(typ, nil, mask)
@@ -481,6 +483,68 @@ func parseTunnelFlowKey(typ uint16, key []byte, mask []byte) (FlowKey, error) {
 	return TunnelFlowKey{key: k, mask: m}, nil
 }
 
+// Flow keys of types we don't know about are kept as opaque bytes,
+// so that flows installed by other programs can still be listed and
+// deleted.  Without knowledge of the key's structure, an exact
+// match mask is taken to be all ones and an ignore mask all zeros,
+// which is only correct for fixed-size keys.  A RawFlowKey without a
+// Key value is treated as ignored, so it is omitted from requests.
+
+type RawFlowKey struct {
+	Type uint16
+	Key  []byte // nil if only a mask was provided
+	Mask []byte
+}
+
+func (key RawFlowKey) typeId() uint16 {
+	return key.Type
+}
+
+func (key RawFlowKey) putKeyNlAttr(msg *NlMsgBuilder) {
+	msg.PutSliceAttr(key.Type, key.Key)
+}
+
+func (key RawFlowKey) putMaskNlAttr(msg *NlMsgBuilder) {
+	msg.PutSliceAttr(key.Type, key.Mask)
+}
+
+func (key RawFlowKey) Ignored() bool {
+	return key.Key == nil || AllBytes(key.Mask, 0)
+}
+
+func (a RawFlowKey) Equals(gb FlowKey) bool {
+	b, ok := gb.(RawFlowKey)
+	if !ok {
+		return false
+	}
+
+	return a.Type == b.Type && bytes.Equal(a.Key, b.Key) &&
+		bytes.Equal(a.Mask, b.Mask)
+}
+
+func rawFlowKeyParser(size int) FlowKeyParser {
+	exact := make([]byte, size)
+	for i := range exact {
+		exact[i] = 0xff
+	}
+
+	return FlowKeyParser{
+		parse: func(typ uint16, key []byte, mask []byte) (FlowKey, error) {
+			res := RawFlowKey{Type: typ}
+			if key != nil {
+				res.Key = append([]byte{}, key...)
+			} else if !AllBytes(mask, 0) {
+				// As for BlobFlowKeys
+				return nil, fmt.Errorf("flow key type %d has non-zero mask without a value (mask %v)", typ, mask)
+			}
+			res.Mask = append([]byte{}, mask...)
+			return res, nil
+		},
+		ignoreMask: make([]byte, size),
+		exactMask:  exact,
+	}
+}
+
 var flowKeyParsers = FlowKeyParsers{
 	// Packet QoS priority flow key
 	OVS_KEY_ATTR_PRIORITY: blobFlowKeyParser(4, nil),
@@ -580,14 +644,14 @@ func parseSetAction(typ uint16, data []byte) (Action, error) {
 
 	var res Action
 	first := true
-	for typ, data := range attrs {
+	for keytyp, keydata := range attrs {
 		if !first {
 			return nil, fmt.Errorf("multiple attributes within OVS_ACTION_ATTR_SET")
 		}
 
-		switch typ {
+		switch keytyp {
 		case OVS_KEY_ATTR_TUNNEL:
-			ta, err := parseTunnelAttrs(data)
+			ta, err := parseTunnelAttrs(keydata)
 			if err != nil {
 				return nil, err
 			}
@@ -595,7 +659,9 @@ func parseSetAction(typ uint16, data []byte) (Action, error) {
 			break
 
 		default:
-			return nil, fmt.Errorf("unsupported OVS_ACTION_ATTR_SET attribute %d", typ)
+			// Keep SET actions on other flow keys intact,
+			// so that they survive being re-installed.
+			res = parseRawAction(typ, data)
 		}
 
 		first = false
@@ -604,9 +670,225 @@ func parseSetAction(typ uint16, data []byte) (Action, error) {
 	return res, nil
 }
 
-var actionParsers = map[uint16](func(uint16, []byte) (Action, error)){
-	OVS_ACTION_ATTR_OUTPUT: parseOutputAction,
-	OVS_ACTION_ATTR_SET:    parseSetAction,
+// OVS_ACTION_ATTR_TRUNC: Truncate the packet to at most the given
+// length when it is output
+
+type TruncateAction uint32
+
+func (TruncateAction) typeId() uint16 {
+	return OVS_ACTION_ATTR_TRUNC
+}
+
+func (ta TruncateAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutUint32Attr(OVS_ACTION_ATTR_TRUNC, uint32(ta))
+}
+
+func (a TruncateAction) Equals(bx Action) bool {
+	b, ok := bx.(TruncateAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parseTruncateAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+	}
+
+	return TruncateAction(*uint32At(data, 0)), nil
+}
+
+// OVS_ACTION_ATTR_CLONE: Apply a list of actions to a copy of the
+// packet, leaving the original unaffected
+
+type CloneAction struct {
+	Actions []Action
+}
+
+func (CloneAction) typeId() uint16 {
+	return OVS_ACTION_ATTR_CLONE
+}
+
+func (ca CloneAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_CLONE, func() {
+		putActions(msg, ca.Actions)
+	})
+}
+
+func (a CloneAction) Equals(bx Action) bool {
+	b, ok := bx.(CloneAction)
+	if !ok {
+		return false
+	}
+	return actionsEqual(a.Actions, b.Actions)
+}
+
+func parseCloneAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseOrderedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	actions, err := parseActions(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return CloneAction{actions}, nil
+}
+
+// OVS_ACTION_ATTR_CHECK_PKT_LEN: Apply one of two lists of actions,
+// depending on whether the packet is longer than PktLen
+
+type CheckPktLenAction struct {
+	PktLen      uint16
+	IfGreater   []Action
+	IfLessEqual []Action
+}
+
+func (CheckPktLenAction) typeId() uint16 {
+	return OVS_ACTION_ATTR_CHECK_PKT_LEN
+}
+
+func (ca CheckPktLenAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_CHECK_PKT_LEN, func() {
+		msg.PutUint16Attr(OVS_CHECK_PKT_LEN_ATTR_PKT_LEN, ca.PktLen)
+		msg.PutNestedAttrs(OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_GREATER, func() {
+			putActions(msg, ca.IfGreater)
+		})
+		msg.PutNestedAttrs(OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_LESS_EQUAL, func() {
+			putActions(msg, ca.IfLessEqual)
+		})
+	})
+}
+
+func (a CheckPktLenAction) Equals(bx Action) bool {
+	b, ok := bx.(CheckPktLenAction)
+	if !ok {
+		return false
+	}
+	return a.PktLen == b.PktLen &&
+		actionsEqual(a.IfGreater, b.IfGreater) &&
+		actionsEqual(a.IfLessEqual, b.IfLessEqual)
+}
+
+func parseCheckPktLenAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var res CheckPktLenAction
+	res.PktLen, err = attrs.GetUint16(OVS_CHECK_PKT_LEN_ATTR_PKT_LEN)
+	if err != nil {
+		return nil, err
+	}
+
+	greater, err := attrs.GetOrderedAttrs(OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_GREATER)
+	if err != nil {
+		return nil, err
+	}
+
+	res.IfGreater, err = parseActions(greater)
+	if err != nil {
+		return nil, err
+	}
+
+	lessEqual, err := attrs.GetOrderedAttrs(OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_LESS_EQUAL)
+	if err != nil {
+		return nil, err
+	}
+
+	res.IfLessEqual, err = parseActions(lessEqual)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+var actionParsers map[uint16](func(uint16, []byte) (Action, error))
+
+func init() {
+	// Initialized here rather than in the declaration, because
+	// the parsers of nested action lists refer back to
+	// actionParsers.
+	actionParsers = map[uint16](func(uint16, []byte) (Action, error)){
+		OVS_ACTION_ATTR_OUTPUT:        parseOutputAction,
+		OVS_ACTION_ATTR_SET:           parseSetAction,
+		OVS_ACTION_ATTR_CT:            parseConntrackAction,
+		OVS_ACTION_ATTR_METER:         parseMeterAction,
+		OVS_ACTION_ATTR_TRUNC:         parseTruncateAction,
+		OVS_ACTION_ATTR_CLONE:         parseCloneAction,
+		OVS_ACTION_ATTR_CHECK_PKT_LEN: parseCheckPktLenAction,
+	}
+}
+
+// Actions of types we don't know about are kept as opaque bytes
+
+type RawAction struct {
+	Type uint16
+	Data []byte
+}
+
+func (a RawAction) typeId() uint16 {
+	return a.Type
+}
+
+func (a RawAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutSliceAttr(a.Type, a.Data)
+}
+
+func (a RawAction) Equals(bx Action) bool {
+	b, ok := bx.(RawAction)
+	if !ok {
+		return false
+	}
+	return a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+}
+
+func parseRawAction(typ uint16, data []byte) RawAction {
+	return RawAction{Type: typ, Data: append([]byte{}, data...)}
+}
+
+func parseActions(attrs []Attr) ([]Action, error) {
+	actions := make([]Action, 0)
+	for _, actattr := range attrs {
+		parser, ok := actionParsers[actattr.typ]
+		if !ok {
+			actions = append(actions, parseRawAction(actattr.typ, actattr.val))
+			continue
+		}
+
+		action, err := parser(actattr.typ, actattr.val)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, nil
+}
+
+func putActions(msg *NlMsgBuilder, actions []Action) {
+	for _, a := range actions {
+		a.toNlAttr(msg)
+	}
+}
+
+func actionsEqual(a []Action, b []Action) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+
+	return true
 }
 
 // Complete flows
@@ -629,9 +911,25 @@ func (f *FlowSpec) AddAction(a Action) {
 	f.Actions = append(f.Actions, a)
 }
 
+// The flow keys in order of type, so that the requests built from
+// them are reproducible (e.g. when replaying recorded traffic).
+func (keys FlowKeys) sorted() []FlowKey {
+	res := make([]FlowKey, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, k)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].typeId() < res[j].typeId()
+	})
+	return res
+}
+
 func (f FlowSpec) toNlAttrs(msg *NlMsgBuilder) {
+	keys := f.FlowKeys.sorted()
+
 	msg.PutNestedAttrs(OVS_FLOW_ATTR_KEY, func() {
-		for _, k := range f.FlowKeys {
+		for _, k := range keys {
 			if !k.Ignored() {
 				k.putKeyNlAttr(msg)
 			}
@@ -639,7 +937,7 @@ func (f FlowSpec) toNlAttrs(msg *NlMsgBuilder) {
 	})
 
 	msg.PutNestedAttrs(OVS_FLOW_ATTR_MASK, func() {
-		for _, k := range f.FlowKeys {
+		for _, k := range keys {
 			if !k.Ignored() {
 				k.putMaskNlAttr(msg)
 			}
@@ -648,9 +946,7 @@ func (f FlowSpec) toNlAttrs(msg *NlMsgBuilder) {
 
 	// ACTIONS is required
 	msg.PutNestedAttrs(OVS_FLOW_ATTR_ACTIONS, func() {
-		for _, a := range f.Actions {
-			a.toNlAttr(msg)
-		}
+		putActions(msg, f.Actions)
 	})
 }
 
@@ -658,17 +954,8 @@ func (a FlowSpec) Equals(b FlowSpec) bool {
 	if !a.FlowKeys.Equals(b.FlowKeys) {
 		return false
 	}
-	if len(a.Actions) != len(b.Actions) {
-		return false
-	}
-
-	for i := range a.Actions {
-		if !a.Actions[i].Equals(b.Actions[i]) {
-			return false
-		}
-	}
 
-	return true
+	return actionsEqual(a.Actions, b.Actions)
 }
 
 func (dp DatapathHandle) checkOvsHeader(msg *NlMsgParser) error {
@@ -727,25 +1014,15 @@ func (dp DatapathHandle) parseFlowSpec(msg *NlMsgParser) (FlowSpec, error) {
 		return f, err
 	}
 
-	actions := make([]Action, 0)
-	for _, actattr := range actattrs {
-		parser, ok := actionParsers[actattr.typ]
-		if !ok {
-			return f, fmt.Errorf("unknown action type %d (value %v)", actattr.typ, actattr.val)
-		}
-
-		action, err := parser(actattr.typ, actattr.val)
-		if err != nil {
-			return f, err
-		}
-		actions = append(actions, action)
-	}
-
-	f.Actions = actions
-	return f, nil
+	f.Actions, err = parseActions(actattrs)
+	return f, err
 }
 
 func (dp DatapathHandle) CreateFlow(f FlowSpec) error {
+	return dp.CreateFlowContext(context.Background(), f)
+}
+
+func (dp DatapathHandle) CreateFlowContext(ctx context.Context, f FlowSpec) error {
 	dpif := dp.dpif
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[FLOW])
@@ -753,19 +1030,15 @@ func (dp DatapathHandle) CreateFlow(f FlowSpec) error {
 	req.putOvsHeader(dp.ifindex)
 	f.toNlAttrs(req)
 
-	_, err := dpif.sock.Request(req)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err := dpif.request(ctx, "create flow", FLOW, dp.name, req)
+	return err
 }
 
-type NoSuchFlowError struct{}
-
-func (NoSuchFlowError) Error() string { return "no such flow" }
-
 func (dp DatapathHandle) DeleteFlow(f FlowSpec) error {
+	return dp.DeleteFlowContext(context.Background(), f)
+}
+
+func (dp DatapathHandle) DeleteFlowContext(ctx context.Context, f FlowSpec) error {
 	dpif := dp.dpif
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[FLOW])
@@ -773,21 +1046,26 @@ func (dp DatapathHandle) DeleteFlow(f FlowSpec) error {
 	req.putOvsHeader(dp.ifindex)
 	f.toNlAttrs(req)
 
-	_, err := dpif.sock.Request(req)
-	if err == NetlinkError(syscall.ENOENT) {
-		err = NoSuchFlowError{}
-	}
-
+	_, err := dpif.request(ctx, "delete flow", FLOW, dp.name, req)
 	return err
 }
 
 func (dp DatapathHandle) EnumerateFlows() ([]FlowSpec, error) {
+	return dp.EnumerateFlowsContext(context.Background())
+}
+
+func (dp DatapathHandle) EnumerateFlowsContext(ctx context.Context) ([]FlowSpec, error) {
 	dpif := dp.dpif
-	res := make([]FlowSpec, 0)
+	var res []FlowSpec
 
-	req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[FLOW])
-	req.PutGenlMsghdr(OVS_FLOW_CMD_GET, OVS_FLOW_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	newReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[FLOW])
+		req.PutGenlMsghdr(OVS_FLOW_CMD_GET, OVS_FLOW_VERSION)
+		req.putOvsHeader(dp.ifindex)
+		return req
+	}
+
+	reset := func() { res = make([]FlowSpec, 0) }
 
 	consumer := func(resp *NlMsgParser) error {
 		f, err := dp.parseFlowSpec(resp)
@@ -798,7 +1076,7 @@ func (dp DatapathHandle) EnumerateFlows() ([]FlowSpec, error) {
 		return nil
 	}
 
-	err := dpif.sock.RequestMulti(req, consumer)
+	err := dpif.dump(ctx, "enumerate flows", FLOW, dp.name, newReq, reset, consumer)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,147 @@
+package odp
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Encode an action and parse it back, without involving the kernel
+func roundTripAction(a Action, t *testing.T) Action {
+	msg := NewNlMsgBuilder(0, 0)
+	a.toNlAttr(msg)
+	data, _ := msg.Finish()
+
+	attrs, err := ParseOrderedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := parseActions(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actions) != 1 {
+		t.Fatalf("expected one action, got %d", len(actions))
+	}
+
+	return actions[0]
+}
+
+func checkRoundTripAction(a Action, t *testing.T) {
+	b := roundTripAction(a, t)
+	if !a.Equals(b) {
+		t.Fatalf("action changed after round trip: %v became %v", a, b)
+	}
+}
+
+func TestConntrackAction(t *testing.T) {
+	checkRoundTripAction(ConntrackAction{}, t)
+
+	checkRoundTripAction(ConntrackAction{
+		Commit:           true,
+		Zone:             42,
+		ZonePresent:      true,
+		Mark:             0x12,
+		MarkMask:         0xff,
+		MarkPresent:      true,
+		Labels:           [OVS_CT_LABELS_LEN]byte{1, 2, 3},
+		LabelsMask:       [OVS_CT_LABELS_LEN]byte{0xff, 0xff, 0xff},
+		LabelsPresent:    true,
+		Helper:           "ftp",
+		EventMask:        1,
+		EventMaskPresent: true,
+		Nat: &ConntrackNat{
+			Src:             true,
+			IpMin:           []byte{10, 0, 0, 1},
+			IpMax:           []byte{10, 0, 0, 10},
+			ProtoMin:        1024,
+			ProtoMax:        65535,
+			ProtoMinPresent: true,
+			ProtoMaxPresent: true,
+			ProtoRandom:     true,
+		},
+	}, t)
+
+	// NAT with no range reverses the existing NAT
+	checkRoundTripAction(ConntrackAction{Nat: &ConntrackNat{}}, t)
+
+	if (ConntrackAction{Commit: true}).Equals(ConntrackAction{}) {
+		t.Fatal()
+	}
+
+	if (ConntrackAction{Nat: &ConntrackNat{}}).Equals(ConntrackAction{}) {
+		t.Fatal()
+	}
+}
+
+func TestTruncateCloneCheckPktLenActions(t *testing.T) {
+	checkRoundTripAction(TruncateAction(64), t)
+	checkRoundTripAction(CloneAction{}, t)
+	checkRoundTripAction(CloneAction{[]Action{
+		TruncateAction(128),
+		OutputAction(3),
+	}}, t)
+	checkRoundTripAction(CheckPktLenAction{
+		PktLen:      1500,
+		IfGreater:   []Action{CloneAction{[]Action{OutputAction(1)}}},
+		IfLessEqual: []Action{OutputAction(2)},
+	}, t)
+
+	if (CloneAction{[]Action{OutputAction(1)}}).Equals(CloneAction{[]Action{OutputAction(2)}}) {
+		t.Fatal()
+	}
+}
+
+func TestRawFlowKeysAndActions(t *testing.T) {
+	checkRoundTripAction(RawAction{Type: 1000, Data: []byte{1, 2, 3, 4}}, t)
+
+	keys := Attrs{
+		OVS_KEY_ATTR_ETHERTYPE: []byte{0x08, 0x00},
+		1000:                   []byte{1, 2, 3, 4},
+	}
+	masks := Attrs{
+		OVS_KEY_ATTR_ETHERTYPE: []byte{0xff, 0xff},
+		1000:                   []byte{0xff, 0, 0xff, 0},
+		1001:                   []byte{0, 0},
+	}
+
+	fks, err := parseFlowKeys(keys, masks, flowKeyParsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := RawFlowKey{Type: 1000, Key: []byte{1, 2, 3, 4}, Mask: []byte{0xff, 0, 0xff, 0}}
+	if !fks[1000].Equals(expect) {
+		t.Fatal(fks[1000])
+	}
+
+	if !fks[1001].Ignored() {
+		t.Fatal(fks[1001])
+	}
+
+	// Without masks, unknown keys are exact matches
+	fks, err = parseFlowKeys(keys, nil, flowKeyParsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect.Mask = []byte{0xff, 0xff, 0xff, 0xff}
+	if !fks[1000].Equals(expect) {
+		t.Fatal(fks[1000])
+	}
+
+	// A non-zero mask needs a key value
+	_, err = parseFlowKeys(Attrs{}, Attrs{1001: []byte{0xff, 0}}, flowKeyParsers)
+	if err == nil {
+		t.Fatal("expected error for mask without key")
+	}
+
+	if !(RawFlowKey{Type: 1001, Mask: []byte{0xff, 0}}).Ignored() {
+		t.Fatal("raw flow key without value should be ignored")
+	}
+}
+
+func TestMeterAction(t *testing.T) {
+	checkRoundTripAction(MeterAction(7), t)
+}
@@ -1,6 +1,7 @@
 package odp
 
 import (
+	"context"
 	"fmt"
 	"syscall"
 )
@@ -28,12 +29,16 @@ func (nlmsg *NlMsgParser) ExpectGenlMsghdr(cmd uint8) (*GenlMsghdr, error) {
 }
 
 func (s *NetlinkSocket) LookupGenlFamily(name string) (uint16, error) {
+	return s.LookupGenlFamilyContext(context.Background(), name)
+}
+
+func (s *NetlinkSocket) LookupGenlFamilyContext(ctx context.Context, name string) (uint16, error) {
 	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
 
 	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
 	req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, name)
 
-	resp, err := s.Request(req)
+	resp, err := s.RequestContext(ctx, req)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,374 @@
+package odp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+type MeterBand struct {
+	// Band type, e.g. OVS_METER_BAND_TYPE_DROP
+	Type uint32
+
+	// Rate in kilobits per second or packets per second,
+	// depending on MeterSpec.Kbps
+	Rate uint32
+
+	// Burst size, in the same units as Rate
+	Burst uint32
+}
+
+type MeterSpec struct {
+	Id    uint32
+	Kbps  bool
+	Bands []MeterBand
+}
+
+func NewDropMeterSpec(id uint32, kbps bool, rate uint32, burst uint32) MeterSpec {
+	return MeterSpec{
+		Id:    id,
+		Kbps:  kbps,
+		Bands: []MeterBand{{OVS_METER_BAND_TYPE_DROP, rate, burst}},
+	}
+}
+
+func (spec MeterSpec) toNlAttrs(msg *NlMsgBuilder) {
+	msg.PutUint32Attr(OVS_METER_ATTR_ID, spec.Id)
+
+	if spec.Kbps {
+		msg.PutEmptyAttr(OVS_METER_ATTR_KBPS)
+	}
+
+	msg.PutNestedAttrs(OVS_METER_ATTR_BANDS, func() {
+		for _, band := range spec.Bands {
+			msg.PutNestedAttrs(OVS_BAND_ATTR_UNSPEC, func() {
+				msg.PutUint32Attr(OVS_BAND_ATTR_TYPE, band.Type)
+				msg.PutUint32Attr(OVS_BAND_ATTR_RATE, band.Rate)
+				msg.PutUint32Attr(OVS_BAND_ATTR_BURST, band.Burst)
+			})
+		}
+	})
+}
+
+type MeterStats struct {
+	Id uint32
+	OvsFlowStats
+
+	// Time the meter was last used, in milliseconds of system
+	// uptime
+	Used uint64
+
+	// Per-band statistics, in the order the bands were given
+	// when the meter was created
+	Bands []OvsFlowStats
+}
+
+func parseOvsFlowStats(data []byte) (OvsFlowStats, error) {
+	if len(data) != SizeofOvsFlowStats {
+		return OvsFlowStats{}, fmt.Errorf("flow stats attribute has wrong length (%d bytes)", len(data))
+	}
+
+	return *ovsFlowStatsAt(data, 0), nil
+}
+
+func (dp DatapathHandle) parseMeterStats(msg *NlMsgParser, cmd uint8) (res MeterStats, err error) {
+	_, err = msg.ExpectNlMsghdr(dp.dpif.familyIds[METER])
+	if err != nil {
+		return
+	}
+
+	_, err = msg.ExpectGenlMsghdr(cmd)
+	if err != nil {
+		return
+	}
+
+	err = dp.checkOvsHeader(msg)
+	if err != nil {
+		return
+	}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		return
+	}
+
+	res.Id, err = attrs.GetUint32(OVS_METER_ATTR_ID)
+	if err != nil {
+		return
+	}
+
+	stats, err := attrs.Get(OVS_METER_ATTR_STATS, true)
+	if err != nil {
+		return
+	}
+	if stats != nil {
+		res.OvsFlowStats, err = parseOvsFlowStats(stats)
+		if err != nil {
+			return
+		}
+	}
+
+	res.Used, _, err = attrs.GetOptionalUint64(OVS_METER_ATTR_USED)
+	if err != nil {
+		return
+	}
+
+	bands, err := attrs.Get(OVS_METER_ATTR_BANDS, true)
+	if err != nil || bands == nil {
+		return
+	}
+
+	bandattrs, err := ParseOrderedAttrs(bands)
+	if err != nil {
+		return
+	}
+
+	res.Bands = make([]OvsFlowStats, 0, len(bandattrs))
+	for _, bandattr := range bandattrs {
+		var band Attrs
+		band, err = ParseNestedAttrs(bandattr.val)
+		if err != nil {
+			return
+		}
+
+		var bandstats []byte
+		bandstats, err = band.Get(OVS_BAND_ATTR_STATS, false)
+		if err != nil {
+			return
+		}
+
+		var s OvsFlowStats
+		s, err = parseOvsFlowStats(bandstats)
+		if err != nil {
+			return
+		}
+		res.Bands = append(res.Bands, s)
+	}
+
+	return
+}
+
+func (dp DatapathHandle) newMeterRequest(cmd uint8) (*NlMsgBuilder, error) {
+	dpif := dp.dpif
+	if err := dpif.checkFamily(METER); err != nil {
+		return nil, err
+	}
+
+	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[METER])
+	req.PutGenlMsghdr(cmd, OVS_METER_VERSION)
+	req.putOvsHeader(dp.ifindex)
+	return req, nil
+}
+
+// Create a meter, or replace an existing meter with the same id.
+func (dp DatapathHandle) CreateMeter(spec MeterSpec) error {
+	return dp.CreateMeterContext(context.Background(), spec)
+}
+
+func (dp DatapathHandle) CreateMeterContext(ctx context.Context, spec MeterSpec) error {
+	req, err := dp.newMeterRequest(OVS_METER_CMD_SET)
+	if err != nil {
+		return err
+	}
+
+	spec.toNlAttrs(req)
+
+	_, err = dp.dpif.request(ctx, "create meter", METER, dp.name, req)
+	return err
+}
+
+func IsNoSuchMeterError(err error) bool {
+	return errors.Is(err, ErrNoSuchMeter)
+}
+
+func (dp DatapathHandle) DeleteMeter(id uint32) error {
+	return dp.DeleteMeterContext(context.Background(), id)
+}
+
+func (dp DatapathHandle) DeleteMeterContext(ctx context.Context, id uint32) error {
+	req, err := dp.newMeterRequest(OVS_METER_CMD_DEL)
+	if err != nil {
+		return err
+	}
+
+	req.PutUint32Attr(OVS_METER_ATTR_ID, id)
+
+	_, err = dp.dpif.request(ctx, "delete meter", METER, dp.name, req)
+	return err
+}
+
+func (dp DatapathHandle) GetMeterStats(id uint32) (MeterStats, error) {
+	return dp.GetMeterStatsContext(context.Background(), id)
+}
+
+func (dp DatapathHandle) GetMeterStatsContext(ctx context.Context, id uint32) (MeterStats, error) {
+	req, err := dp.newMeterRequest(OVS_METER_CMD_GET)
+	if err != nil {
+		return MeterStats{}, err
+	}
+
+	req.PutUint32Attr(OVS_METER_ATTR_ID, id)
+
+	resp, err := dp.dpif.request(ctx, "get meter stats", METER, dp.name, req)
+	if err != nil {
+		return MeterStats{}, err
+	}
+
+	return dp.parseMeterStats(resp, OVS_METER_CMD_GET)
+}
+
+type MeterFeatures struct {
+	MaxMeters uint32
+	MaxBands  uint32
+}
+
+func (dp DatapathHandle) GetMeterFeatures() (MeterFeatures, error) {
+	return dp.GetMeterFeaturesContext(context.Background())
+}
+
+func (dp DatapathHandle) GetMeterFeaturesContext(ctx context.Context) (MeterFeatures, error) {
+	var res MeterFeatures
+
+	req, err := dp.newMeterRequest(OVS_METER_CMD_FEATURES)
+	if err != nil {
+		return res, err
+	}
+
+	resp, err := dp.dpif.request(ctx, "get meter features", METER, dp.name, req)
+	if err != nil {
+		return res, err
+	}
+
+	_, err = resp.ExpectNlMsghdr(dp.dpif.familyIds[METER])
+	if err != nil {
+		return res, err
+	}
+
+	_, err = resp.ExpectGenlMsghdr(OVS_METER_CMD_FEATURES)
+	if err != nil {
+		return res, err
+	}
+
+	err = dp.checkOvsHeader(resp)
+	if err != nil {
+		return res, err
+	}
+
+	attrs, err := resp.TakeAttrs()
+	if err != nil {
+		return res, err
+	}
+
+	res.MaxMeters, err = attrs.GetUint32(OVS_METER_ATTR_MAX_METERS)
+	if err != nil {
+		return res, err
+	}
+
+	res.MaxBands, err = attrs.GetUint32(OVS_METER_ATTR_MAX_BANDS)
+	return res, err
+}
+
+// EnumerateMeters uses a meter dump if the kernel supports one.  The
+// kernel's ovs_meter family does not currently implement dumps, so
+// otherwise it probes each meter id in turn from zero up to the
+// kernel's MaxMeters, which can take many requests.  The kernel
+// limits the number of meters rather than their ids, so a meter with
+// an id of MaxMeters or above is not found by that scan.  Userspace
+// normally allocates meter ids densely from zero, so this is rarely a
+// problem in practice.
+func (dp DatapathHandle) EnumerateMeters() ([]MeterStats, error) {
+	return dp.EnumerateMetersContext(context.Background())
+}
+
+func (dp DatapathHandle) EnumerateMetersContext(ctx context.Context) ([]MeterStats, error) {
+	res, err := dp.dumpMeters(ctx)
+	if !IsNetlinkError(err, syscall.EOPNOTSUPP) {
+		return res, err
+	}
+
+	features, err := dp.GetMeterFeaturesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once MaxMeters meters have been found, there can be no more
+	res = make([]MeterStats, 0)
+	for id := uint32(0); id < features.MaxMeters && uint32(len(res)) < features.MaxMeters; id++ {
+		stats, err := dp.GetMeterStatsContext(ctx, id)
+		if err != nil {
+			if IsNoSuchMeterError(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		res = append(res, stats)
+	}
+
+	return res, nil
+}
+
+func (dp DatapathHandle) dumpMeters(ctx context.Context) ([]MeterStats, error) {
+	dpif := dp.dpif
+	if err := dpif.checkFamily(METER); err != nil {
+		return nil, err
+	}
+
+	var res []MeterStats
+
+	newReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[METER])
+		req.PutGenlMsghdr(OVS_METER_CMD_GET, OVS_METER_VERSION)
+		req.putOvsHeader(dp.ifindex)
+		return req
+	}
+
+	reset := func() { res = make([]MeterStats, 0) }
+
+	consumer := func(resp *NlMsgParser) error {
+		stats, err := dp.parseMeterStats(resp, OVS_METER_CMD_GET)
+		if err != nil {
+			return err
+		}
+		res = append(res, stats)
+		return nil
+	}
+
+	err := dpif.dump(ctx, "enumerate meters", METER, dp.name, newReq, reset, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// OVS_ACTION_ATTR_METER: Apply a meter to the packet, possibly
+// dropping it
+
+type MeterAction uint32
+
+func (MeterAction) typeId() uint16 {
+	return OVS_ACTION_ATTR_METER
+}
+
+func (ma MeterAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutUint32Attr(OVS_ACTION_ATTR_METER, uint32(ma))
+}
+
+func (a MeterAction) Equals(bx Action) bool {
+	b, ok := bx.(MeterAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parseMeterAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+	}
+
+	return MeterAction(*uint32At(data, 0)), nil
+}
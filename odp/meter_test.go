@@ -0,0 +1,136 @@
+package odp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Create a datapath for meter tests, skipping the test if the
+// kernel does not support meters
+func newMeterTestDatapath(dpif *Dpif, t *testing.T) DatapathHandle {
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dp.GetMeterFeatures(); errors.Is(err, ErrNotSupported) {
+		checkedDeleteDatapath(dp, t)
+		t.Skip("kernel does not support meters")
+	} else if err != nil {
+		checkedDeleteDatapath(dp, t)
+		t.Fatal(err)
+	}
+
+	return dp
+}
+
+func TestCreateMeter(t *testing.T) {
+	dpif, err := newTestDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp := newMeterTestDatapath(dpif, t)
+	defer checkedDeleteDatapath(dp, t)
+
+	features, err := dp.GetMeterFeatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if features.MaxMeters == 0 || features.MaxBands == 0 {
+		t.Fatal(features)
+	}
+
+	err = dp.CreateMeter(NewDropMeterSpec(3, true, 1000, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := dp.GetMeterStats(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Id != 3 || len(stats.Bands) != 1 {
+		t.Fatal(stats)
+	}
+
+	// Creating it again replaces it
+	err = dp.CreateMeter(NewDropMeterSpec(3, false, 10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dp.DeleteMeter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dp.GetMeterStats(3)
+	if !IsNoSuchMeterError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestEnumerateMeters(t *testing.T) {
+	var dpif *Dpif
+	var err error
+	if *kernel {
+		dpif, err = newTestDpif()
+	} else {
+		// Keep the scan of meter ids short
+		k := NewFakeKernel()
+		k.maxMeters = 2000
+		dpif, err = k.NewDpif()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp := newMeterTestDatapath(dpif, t)
+	defer checkedDeleteDatapath(dp, t)
+
+	meters, err := dp.EnumerateMeters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(meters) != 0 {
+		t.Fatal(meters)
+	}
+
+	// The kernel has no meter dump, so the ids are scanned up to
+	// MaxMeters, and a meter beyond that is not found
+	features, err := dp.GetMeterFeatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []uint32{0, 5, 1024, features.MaxMeters - 1, features.MaxMeters}
+	for _, id := range ids {
+		err := dp.CreateMeter(NewDropMeterSpec(id, false, 100, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meters, err = dp.EnumerateMeters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(meters) != 4 {
+		t.Fatal(meters)
+	}
+
+	for i, meter := range meters {
+		if meter.Id != ids[i] {
+			t.Fatal(meters)
+		}
+	}
+}
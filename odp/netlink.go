@@ -1,8 +1,14 @@
 package odp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 )
@@ -11,17 +17,53 @@ func align(n int, a int) int {
 	return (n + a - 1) & -a
 }
 
+// A NetlinkSocket may be used for requests by many goroutines at
+// once.  Replies are routed to the requesting goroutine according to
+// their sequence numbers, by a single reader goroutine that runs
+// while any requests are outstanding.
+//
+// The socket is non-blocking and registered with the Go runtime's
+// poller, so goroutines waiting on it do not tie up OS threads, and
+// Close wakes them.
 type NetlinkSocket struct {
-	fd   int
-	addr *syscall.SockaddrNetlink
+	conn nlConn
+	pid  uint32
+
+	lock    sync.Mutex
+	pending map[uint32]*pendingRequest
+	reading bool
+
+	// After the kernel reports that it dropped datagrams
+	// (ENOBUFS), the sequence number of the probe sent to find
+	// out which requests lost their replies, and the candidates
+	resyncSeq  uint32
+	resyncReqs map[uint32]*pendingRequest
+
+	// Held while sending a request and marking it as sent, and
+	// while sending a resync probe, so that every request is
+	// either sent before the probe and among its candidates, or
+	// sent after it.
+	sendLock sync.Mutex
+
+	// The kernel only allows one dump at a time on a socket.
+	// This is a semaphore rather than a mutex so that waiting
+	// for it can be cancelled.
+	dumpSem chan struct{}
+
+	logger atomic.Pointer[slog.Logger]
+	tracer func(sent bool, data []byte)
 }
 
 func OpenNetlinkSocket(protocol int) (*NetlinkSocket, error) {
-	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, protocol)
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, protocol)
 	if err != nil {
 		return nil, err
 	}
 
+	// Ask for extended error information.  Older kernels don't
+	// support this, and we can do without it.
+	syscall.SetsockoptInt(fd, SOL_NETLINK, NETLINK_EXT_ACK, 1)
+
 	addr := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
 	if err := syscall.Bind(fd, &addr); err != nil {
 		syscall.Close(fd)
@@ -34,25 +76,97 @@ func OpenNetlinkSocket(protocol int) (*NetlinkSocket, error) {
 		return nil, err
 	}
 
-	switch nladdr := localaddr.(type) {
-	case *syscall.SockaddrNetlink:
-		return &NetlinkSocket{fd: fd, addr: nladdr}, nil
-
-	default:
+	nladdr, ok := localaddr.(*syscall.SockaddrNetlink)
+	if !ok {
+		syscall.Close(fd)
 		return nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(localaddr))
 	}
+
+	file := os.NewFile(uintptr(fd), "netlink")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return newNetlinkSocket(&socketConn{file: file, conn: conn}, nladdr.Pid), nil
+}
+
+func newNetlinkSocket(conn nlConn, pid uint32) *NetlinkSocket {
+	return &NetlinkSocket{
+		conn:    conn,
+		pid:     pid,
+		dumpSem: make(chan struct{}, 1),
+	}
 }
 
 func (s *NetlinkSocket) Pid() uint32 {
-	return s.addr.Pid
+	return s.pid
 }
 
 func (s *NetlinkSocket) Close() error {
-	return syscall.Close(s.fd)
+	return s.conn.close()
+}
+
+// A slog.Handler that discards everything
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// Set the logger for diagnostics about the traffic on the socket.
+// Requests, replies and discarded messages are logged at debug
+// level, so a handler at a higher level costs little.  A nil logger
+// (the default) discards everything.
+func (s *NetlinkSocket) SetLogger(logger *slog.Logger) {
+	s.logger.Store(logger)
+}
+
+func (s *NetlinkSocket) log() *slog.Logger {
+	if logger := s.logger.Load(); logger != nil {
+		return logger
+	}
+
+	return discardLogger
+}
+
+// Set a function to be called with each datagram sent or received
+// on the socket, e.g. to pass to DecodeNetlinkMessages.  The data is
+// only valid during the call.  The tracer may be called concurrently
+// from different goroutines.  This should be called before the
+// socket is used.
+func (s *NetlinkSocket) SetTracer(tracer func(sent bool, data []byte)) {
+	s.tracer = tracer
+}
+
+// Log a message at debug level, along with its netlink header.  This
+// is called for every message, so avoid the cost of building the
+// attributes if they are not wanted.
+func (s *NetlinkSocket) logMsg(what string, data []byte, pos int) {
+	logger := s.log()
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	h := nlMsghdrAt(data, pos)
+	logger.LogAttrs(context.Background(), slog.LevelDebug, what,
+		slog.Uint64("seq", uint64(h.Seq)),
+		slog.Uint64("type", uint64(h.Type)),
+		slog.Uint64("flags", uint64(h.Flags)),
+		slog.Uint64("len", uint64(h.Len)))
 }
 
 type NlMsgBuilder struct {
 	buf []byte
+
+	// The position of the first attribute, so that the offset in
+	// an extended ACK can be mapped back to an attribute by
+	// walking the attributes from there
+	attrsStart int
 }
 
 func NewNlMsgBuilder(flags uint16, typ uint16) *NlMsgBuilder {
@@ -118,12 +232,48 @@ func (nlmsg *NlMsgBuilder) Finish() (res []byte, seq uint32) {
 
 func (nlmsg *NlMsgBuilder) PutAttr(typ uint16, gen func()) {
 	pos := nlmsg.AlignGrow(syscall.NLA_ALIGNTO, syscall.SizeofNlAttr)
+	if nlmsg.attrsStart == 0 {
+		nlmsg.attrsStart = pos
+	}
 	gen()
 	nla := nlAttrAt(nlmsg.buf, pos)
 	nla.Type = typ
 	nla.Len = uint16(len(nlmsg.buf) - pos)
 }
 
+// Find the types of the attributes of a request that contain the
+// given offset, outermost first, by walking the attributes starting
+// at start.  An attribute containing the offset is taken to hold
+// nested attributes unless the offset is at its start.
+func attrPath(req []byte, start int, offset int) []uint16 {
+	if start == 0 {
+		return nil
+	}
+
+	var path []uint16
+	pos, end := start, len(req)
+	for pos+syscall.SizeofNlAttr <= end {
+		nla := nlAttrAt(req, pos)
+		l := int(nla.Len)
+		if l < syscall.SizeofNlAttr || pos+l > end {
+			break
+		}
+
+		if offset < pos || offset >= pos+l {
+			pos += align(l, syscall.NLA_ALIGNTO)
+			continue
+		}
+
+		path = append(path, nla.Type&NLA_TYPE_MASK)
+		if offset == pos {
+			break
+		}
+
+		pos, end = pos+syscall.SizeofNlAttr, pos+l
+	}
+	return path
+}
+
 func (nlmsg *NlMsgBuilder) PutNestedAttrs(typ uint16, gen func()) {
 	nlmsg.PutAttr(typ, func() {
 		gen()
@@ -161,6 +311,15 @@ func (nlmsg *NlMsgBuilder) PutUint32Attr(typ uint16, val uint32) {
 	})
 }
 
+func (nlmsg *NlMsgBuilder) PutUint32ArrayAttr(typ uint16, vals []uint32) {
+	nlmsg.PutAttr(typ, func() {
+		for _, val := range vals {
+			pos := nlmsg.Grow(4)
+			*uint32At(nlmsg.buf, pos) = val
+		}
+	})
+}
+
 func (nlmsg *NlMsgBuilder) putStringZ(str string) {
 	l := len(str)
 	pos := nlmsg.Grow(uintptr(l) + 1)
@@ -179,12 +338,68 @@ func (nlmsg *NlMsgBuilder) PutSliceAttr(typ uint16, data []byte) {
 	})
 }
 
+func IsDumpInterruptedError(err error) bool {
+	return errors.Is(err, ErrDumpInterrupted)
+}
+
 type NetlinkError syscall.Errno
 
 func (err NetlinkError) Error() string {
 	return fmt.Sprintf("netlink error response: %s", syscall.Errno(err))
 }
 
+// So that errors.Is(err, syscall.ENOENT) etc. work
+func (err NetlinkError) Unwrap() error {
+	return syscall.Errno(err)
+}
+
+// A netlink error response that carries extended ACK information
+type NetlinkExtendedError struct {
+	NetlinkError
+
+	// Message from the kernel (NLMSGERR_ATTR_MSG), or empty
+	Msg string
+
+	// The types of the request attribute identified by
+	// NLMSGERR_ATTR_OFFS and the attributes enclosing it,
+	// outermost first.  Nil if the kernel did not identify an
+	// attribute, or it could not be found in the request.
+	AttrPath []uint16
+}
+
+func (err NetlinkExtendedError) Unwrap() error {
+	return err.NetlinkError
+}
+
+func (err NetlinkExtendedError) Error() string {
+	res := err.NetlinkError.Error()
+	if err.Msg != "" {
+		res += ": " + err.Msg
+	}
+
+	if err.AttrPath != nil {
+		res += " (attribute"
+		for i, typ := range err.AttrPath {
+			if i == 0 {
+				res += " "
+			} else {
+				res += "/"
+			}
+			res += fmt.Sprint(typ)
+		}
+		res += ")"
+	}
+
+	return res
+}
+
+// Check whether err is a netlink error response with the given
+// errno, with or without extended ACK information
+func IsNetlinkError(err error, errno syscall.Errno) bool {
+	var nlerr NetlinkError
+	return errors.As(err, &nlerr) && nlerr == NetlinkError(errno)
+}
+
 type NlMsgParser struct {
 	data []byte
 	pos  int
@@ -238,29 +453,24 @@ func (nlmsg *NlMsgParser) AlignAdvance(a int, size uintptr) (int, error) {
 	return pos, nil
 }
 
-func (nlmsg *NlMsgParser) checkHeader(s *NetlinkSocket, expectedSeq uint32) (*syscall.NlMsghdr, error) {
+// req and attrsStart give the request and the position of its
+// attributes, if known, to interpret extended ACKs.
+func (nlmsg *NlMsgParser) checkHeader(s *NetlinkSocket, req []byte, attrsStart int) (*syscall.NlMsghdr, error) {
 	h := nlMsghdrAt(nlmsg.data, nlmsg.pos)
 	if h.Pid != s.Pid() {
 		return nil, fmt.Errorf("netlink reply pid mismatch (got %d, expected %d)", h.Pid, s.Pid())
 	}
 
-	if h.Seq != expectedSeq {
-		// This doesn't necessarily indicate an error.  For
-		// example, if a requestMulti was interrupted due to
-		// an error, we might still be getting response
-		// messages back, that we should simply discard.  On
-		// the other hand, sequence number mismatches might
-		// indicate bugs, so it is sometimes nice to see them
-		// in development.
-		fmt.Printf("netlink reply sequence number mismatch (got %d, expected %d)\n", h.Seq, expectedSeq)
-		return nil, nil
-	}
-
 	if h.Type == syscall.NLMSG_ERROR {
 		nlerr := nlMsgerrAt(nlmsg.data, nlmsg.pos+syscall.NLMSG_HDRLEN)
 
 		if nlerr.Error != 0 {
-			return nil, NetlinkError(-nlerr.Error)
+			err := NetlinkError(-nlerr.Error)
+			if h.Flags&NLM_F_ACK_TLVS == 0 {
+				return nil, err
+			}
+
+			return nil, nlmsg.parseExtendedAck(h, nlerr, err, req, attrsStart)
 		}
 
 		// an error code of 0 means the erorr is an ack, so
@@ -270,6 +480,37 @@ func (nlmsg *NlMsgParser) checkHeader(s *NetlinkSocket, expectedSeq uint32) (*sy
 	return h, nil
 }
 
+func (nlmsg *NlMsgParser) parseExtendedAck(h *syscall.NlMsghdr, nlerr *syscall.NlMsgerr, err NetlinkError, req []byte, attrsStart int) error {
+	// The extended ACK attributes follow the original request,
+	// or just its header if the reply is capped
+	pos := nlmsg.pos + syscall.NLMSG_HDRLEN + syscall.SizeofNlMsgerr
+	if h.Flags&NLM_F_CAPPED == 0 {
+		pos += int(nlerr.Msg.Len) - syscall.NLMSG_HDRLEN
+	}
+	pos = align(pos, syscall.NLMSG_ALIGNTO)
+
+	end := nlmsg.pos + int(h.Len)
+	if pos > end || end > len(nlmsg.data) {
+		return err
+	}
+
+	attrs, perr := ParseNestedAttrs(nlmsg.data[pos:end])
+	if perr != nil {
+		return err
+	}
+
+	res := NetlinkExtendedError{NetlinkError: err}
+	if msg, _ := attrs.Get(NLMSGERR_ATTR_MSG, true); len(msg) > 0 {
+		res.Msg = strings.TrimRight(string(msg), "\x00")
+	}
+
+	if offs, present, _ := attrs.GetOptionalUint32(NLMSGERR_ATTR_OFFS); present {
+		res.AttrPath = attrPath(req, attrsStart, int(offs))
+	}
+
+	return res
+}
+
 func (nlmsg *NlMsgParser) ExpectNlMsghdr(typ uint16) (*syscall.NlMsghdr, error) {
 	h := nlMsghdrAt(nlmsg.data, nlmsg.pos)
 
@@ -335,6 +576,32 @@ func (attrs Attrs) GetOptionalUint8(typ uint16) (uint8, bool, error) {
 	return val[0], true, nil
 }
 
+func (attrs Attrs) GetOptionalUint16(typ uint16) (uint16, bool, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return 0, false, err
+	}
+
+	if len(val) != 2 {
+		return 0, false, fmt.Errorf("uint16 attribute %d has wrong length (%d bytes)", typ, len(val))
+	}
+
+	return *uint16At(val, 0), true, nil
+}
+
+func (attrs Attrs) GetOptionalUint32(typ uint16) (uint32, bool, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return 0, false, err
+	}
+
+	if len(val) != 4 {
+		return 0, false, fmt.Errorf("uint32 attribute %d has wrong length (%d bytes)", typ, len(val))
+	}
+
+	return *uint32At(val, 0), true, nil
+}
+
 func (attrs Attrs) GetUint16(typ uint16) (uint16, error) {
 	val, err := attrs.Get(typ, false)
 	if err != nil {
@@ -361,6 +628,37 @@ func (attrs Attrs) GetUint32(typ uint16) (uint32, error) {
 	return *uint32At(val, 0), nil
 }
 
+func (attrs Attrs) GetOptionalUint64(typ uint16) (uint64, bool, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return 0, false, err
+	}
+
+	if len(val) != 8 {
+		return 0, false, fmt.Errorf("uint64 attribute %d has wrong length (%d bytes)", typ, len(val))
+	}
+
+	return *uint64At(val, 0), true, nil
+}
+
+func (attrs Attrs) GetUint32Array(typ uint16, optional bool) ([]uint32, error) {
+	val, err := attrs.Get(typ, optional)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	if len(val)%4 != 0 {
+		return nil, fmt.Errorf("uint32 array attribute %d has wrong length (%d bytes)", typ, len(val))
+	}
+
+	res := make([]uint32, len(val)/4)
+	for i := range res {
+		res[i] = *uint32At(val, i*4)
+	}
+
+	return res, nil
+}
+
 func (attrs Attrs) GetString(typ uint16) (string, error) {
 	val, err := attrs.Get(typ, false)
 	if err != nil {
@@ -378,6 +676,19 @@ func (attrs Attrs) GetString(typ uint16) (string, error) {
 	return string(val[0 : len(val)-1]), nil
 }
 
+func (attrs Attrs) GetOptionalString(typ uint16) (string, bool, error) {
+	if _, ok := attrs[typ]; !ok {
+		return "", false, nil
+	}
+
+	str, err := attrs.GetString(typ)
+	if err != nil {
+		return "", false, err
+	}
+
+	return str, true, nil
+}
+
 func (nlmsg *NlMsgParser) checkData(l uintptr, obj string) error {
 	if nlmsg.pos+int(l) <= len(nlmsg.data) {
 		return nil
@@ -442,145 +753,683 @@ type Attr struct {
 	val []byte
 }
 
+func ParseOrderedAttrs(data []byte) ([]Attr, error) {
+	parser := NlMsgParser{data: data, pos: 0}
+	res := make([]Attr, 0)
+	err := parser.parseAttrs(func(typ uint16, val []byte) {
+		res = append(res, Attr{typ, val})
+	})
+
+	return res, err
+}
+
 func (attrs Attrs) GetOrderedAttrs(typ uint16) ([]Attr, error) {
 	val, err := attrs.Get(typ, false)
 	if val == nil {
 		return nil, err
 	}
 
-	parser := NlMsgParser{data: val, pos: 0}
-	res := make([]Attr, 0)
-	err = parser.parseAttrs(func(typ uint16, val []byte) {
-		res = append(res, Attr{typ, val})
-	})
+	return ParseOrderedAttrs(val)
+}
 
-	return res, err
+// What a NetlinkSocket sends and receives datagrams over: normally
+// a real netlink socket, but possibly a Transport.
+type nlConn interface {
+	// Send a datagram to the given netlink port id
+	sendto(data []byte, peer uint32) error
+
+	// Receive a datagram, returning a buffer holding a reference
+	// that the caller must release, the length of the datagram,
+	// and the sender's port id
+	recvfrom() (*recvBuffer, int, uint32, error)
+
+	close() error
 }
 
-func (s *NetlinkSocket) send(msg *NlMsgBuilder) (uint32, error) {
+type socketConn struct {
+	file *os.File
+	conn syscall.RawConn
+}
+
+func (c *socketConn) sendto(data []byte, peer uint32) error {
 	sa := syscall.SockaddrNetlink{
 		Family: syscall.AF_NETLINK,
-		Pid:    0,
+		Pid:    peer,
 		Groups: 0,
 	}
 
-	data, seq := msg.Finish()
-	return seq, syscall.Sendto(s.fd, data, 0, &sa)
+	var serr error
+	err := c.conn.Write(func(fd uintptr) bool {
+		serr = syscall.Sendto(int(fd), data, 0, &sa)
+		return serr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
 }
 
-func (s *NetlinkSocket) recv(peer uint32) (*NlMsgParser, error) {
-	buf := make([]byte, syscall.Getpagesize())
-	nr, from, err := syscall.Recvfrom(s.fd, buf, 0)
+func (c *socketConn) recvfrom() (*recvBuffer, int, uint32, error) {
+	var b *recvBuffer
+	var nr int
+	var from syscall.Sockaddr
+	var rerr error
+	err := c.conn.Read(func(fd uintptr) bool {
+		// Find the size of the datagram first, so that it
+		// never gets truncated
+		var size int
+		size, _, rerr = syscall.Recvfrom(int(fd), nil, syscall.MSG_PEEK|syscall.MSG_TRUNC)
+		if rerr != nil {
+			return rerr != syscall.EAGAIN
+		}
+
+		b = getRecvBuffer(size)
+		nr, from, rerr = syscall.Recvfrom(int(fd), b.buf, 0)
+		if rerr != nil {
+			b.release()
+			b = nil
+		}
+		return rerr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
+	}
+
+	nlfrom, ok := from.(*syscall.SockaddrNetlink)
+	if !ok {
+		b.release()
+		return nil, 0, 0, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(from))
 	}
 
-	switch nlfrom := from.(type) {
-	case *syscall.SockaddrNetlink:
-		if nlfrom.Pid != peer {
-			return nil, fmt.Errorf("wrong netlink peer pid (expected %d, got %d)", peer, nlfrom.Pid)
+	return b, nr, nlfrom.Pid, nil
+}
+
+func (c *socketConn) close() error {
+	return c.file.Close()
+}
+
+// A Transport carries netlink datagrams between a NetlinkSocket and
+// something standing in for the kernel, such as a FakeKernel or a
+// replay of recorded traffic.
+type Transport interface {
+	// Send a datagram to the kernel
+	Send(data []byte) error
+
+	// Receive the next datagram from the kernel, blocking until
+	// one is available.  After Close, this returns an error.
+	Receive() ([]byte, error)
+
+	// The netlink port id of the local end, which the kernel
+	// puts in its replies
+	Pid() uint32
+
+	Close() error
+}
+
+// Create a NetlinkSocket that uses a Transport rather than a real
+// netlink socket.
+func NewTransportNetlinkSocket(t Transport) *NetlinkSocket {
+	return newNetlinkSocket(transportConn{t}, t.Pid())
+}
+
+type transportConn struct {
+	t Transport
+}
+
+func (c transportConn) sendto(data []byte, peer uint32) error {
+	if peer != 0 {
+		return fmt.Errorf("netlink transport can only send to the kernel")
+	}
+
+	return c.t.Send(data)
+}
+
+func (c transportConn) recvfrom() (*recvBuffer, int, uint32, error) {
+	data, err := c.t.Receive()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	b := getRecvBuffer(len(data))
+	copy(b.buf, data)
+	return b, len(data), 0, nil
+}
+
+func (c transportConn) close() error {
+	return c.t.Close()
+}
+
+func (s *NetlinkSocket) send(data []byte) error {
+	err := s.conn.sendto(data, 0)
+	if err == nil && s.tracer != nil {
+		s.tracer(true, data)
+	}
+
+	return err
+}
+
+// Datagrams that fit are received into pooled buffers of this size.
+// The kernel sizes dump datagrams according to the receive buffers
+// it sees, up to about 32KiB, so this also minimizes the number of
+// datagrams in a dump.
+const recvBufferSize = 32768
+
+// A receive buffer, reference counted so that it can be returned to
+// the pool once all the messages in it have been consumed.
+type recvBuffer struct {
+	buf  []byte
+	refs int32
+}
+
+var recvBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &recvBuffer{buf: make([]byte, recvBufferSize)}
+	},
+}
+
+func getRecvBuffer(size int) *recvBuffer {
+	var b *recvBuffer
+	if size <= recvBufferSize {
+		b = recvBufferPool.Get().(*recvBuffer)
+	} else {
+		b = &recvBuffer{buf: make([]byte, size)}
+	}
+
+	b.refs = 1
+	return b
+}
+
+func (b *recvBuffer) hold() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+func (b *recvBuffer) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 && len(b.buf) == recvBufferSize {
+		recvBufferPool.Put(b)
+	}
+}
+
+// A datagram arrived from an unexpected netlink port
+type wrongPeerError struct {
+	expected uint32
+	got      uint32
+}
+
+func (err wrongPeerError) Error() string {
+	return fmt.Sprintf("wrong netlink peer pid (expected %d, got %d)", err.expected, err.got)
+}
+
+// Receive a datagram.  The returned buffer holds a reference that
+// the caller must release when it is done with the messages.
+func (s *NetlinkSocket) recv(peer uint32) (*NlMsgParser, *recvBuffer, error) {
+	b, nr, from, err := s.conn.recvfrom()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.tracer != nil {
+		s.tracer(false, b.buf[:nr])
+	}
+
+	if from != peer {
+		b.release()
+		return nil, nil, wrongPeerError{expected: peer, got: from}
+	}
+
+	return &NlMsgParser{data: b.buf[:nr], pos: 0}, b, nil
+}
+
+// Receive unsolicited messages, such as upcalls.  This blocks until
+// a datagram arrives, and passes each message in it to the consumer.
+// It should not be used on a socket that is also used for requests.
+// The messages are only valid until the consumer returns.
+func (s *NetlinkSocket) Receive(consumer func(*NlMsgParser) error) error {
+	resp, b, err := s.recv(0)
+	if err != nil {
+		return err
+	}
+	defer b.release()
+
+	for {
+		msg, err := resp.nextNlMsg()
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return nil
 		}
 
-		return &NlMsgParser{data: buf[:nr], pos: 0}, nil
+		if err := consumer(msg); err != nil {
+			return err
+		}
+	}
+}
 
+type nlReply struct {
+	msg *NlMsgParser
+	buf *recvBuffer
+	err error
+}
+
+func (r nlReply) release() {
+	if r.buf != nil {
+		r.buf.release()
+	}
+}
+
+// A request awaiting replies.  The reader goroutine queues replies
+// rather than handing them over directly, so that it never blocks on
+// a requester that is busy (perhaps waiting on a nested request made
+// from a dump consumer).
+type pendingRequest struct {
+	lock    sync.Mutex
+	replies []nlReply
+	ready   chan struct{}
+
+	// The request as sent, and the position of its attributes
+	req        []byte
+	attrsStart int
+
+	// Whether the request asked for an ack following its reply
+	ack bool
+
+	// Protected by the NetlinkSocket's lock.  sent is set just
+	// before the request is sent, and replied once its first
+	// reply arrives.
+	sent    bool
+	replied bool
+}
+
+// Whether a reply is the last one for its request
+func (p *pendingRequest) isFinal(h *syscall.NlMsghdr) bool {
+	switch {
+	case h.Type == syscall.NLMSG_ERROR || h.Type == syscall.NLMSG_DONE:
+		return true
+	case h.Flags&syscall.NLM_F_MULTI != 0:
+		return false
 	default:
-		return nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(from))
+		return !p.ack
 	}
 }
 
-// Some generic netlink operations always return a reply message (e.g
-// *_GET), others don't by default (e.g. *_NEW).  In the latter case,
-// NLM_F_ECHO forces a reply.  This is undocumented AFAICT.
-const RequestFlags = syscall.NLM_F_REQUEST | syscall.NLM_F_ECHO
+func (p *pendingRequest) put(r nlReply) {
+	p.lock.Lock()
+	p.replies = append(p.replies, r)
+	p.lock.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pendingRequest) take(ctx context.Context) nlReply {
+	for {
+		p.lock.Lock()
+		if len(p.replies) > 0 {
+			r := p.replies[0]
+			p.replies = p.replies[1:]
+			p.lock.Unlock()
+			return r
+		}
+		p.lock.Unlock()
+
+		select {
+		case <-p.ready:
+		case <-ctx.Done():
+			return nlReply{err: ctx.Err()}
+		}
+	}
+}
+
+// Send a request, having registered to receive its replies.  The
+// caller must call endRequest when it has no further interest in
+// replies.
+func (s *NetlinkSocket) startRequest(req *NlMsgBuilder) (*pendingRequest, uint32, error) {
+	p := &pendingRequest{ready: make(chan struct{}, 1), attrsStart: req.attrsStart}
+	data, seq := req.Finish()
+	p.req = data
+	p.ack = nlMsghdrAt(data, 0).Flags&syscall.NLM_F_ACK != 0
+
+	s.lock.Lock()
+	if s.pending == nil {
+		s.pending = make(map[uint32]*pendingRequest)
+	}
+	s.pending[seq] = p
+	startReader := !s.reading
+	s.reading = true
+	s.lock.Unlock()
+
+	if startReader {
+		go s.readReplies()
+	}
+
+	// The reply might arrive, or be dropped, before send
+	// returns, so the request counts as sent from now on
+	s.sendLock.Lock()
+	s.lock.Lock()
+	p.sent = true
+	s.lock.Unlock()
+	err := s.send(data)
+	s.sendLock.Unlock()
 
-// Do a netlink request that yields a single response message.
-func (s *NetlinkSocket) Request(req *NlMsgBuilder) (*NlMsgParser, error) {
-	seq, err := s.send(req)
 	if err != nil {
-		return nil, err
+		s.log().Debug("netlink send failed", "seq", seq, "err", err)
+		s.endRequest(seq)
+		return nil, 0, err
 	}
 
+	s.logMsg("netlink request", data, 0)
+	return p, seq, nil
+}
+
+func (s *NetlinkSocket) endRequest(seq uint32) {
+	s.lock.Lock()
+	delete(s.pending, seq)
+	s.lock.Unlock()
+}
+
+// The reader goroutine.  It exits once there are no outstanding
+// requests, checking after each datagram.  Requests are unregistered
+// as their final replies are dispatched, so normally it exits after
+// the datagram holding the last reply.  But if a request was
+// abandoned because its context was done, the reader stays blocked
+// until another datagram arrives (perhaps the abandoned reply), or
+// the socket is closed.
+func (s *NetlinkSocket) readReplies() {
 	for {
-		resp, err := s.recv(0)
-		if err != nil {
-			return nil, err
+		resp, b, err := s.recv(0)
+		var wrongPeer wrongPeerError
+		switch {
+		case err == nil:
+			s.dispatchReplies(resp, b)
+			b.release()
+
+		case errors.As(err, &wrongPeer):
+			// Not a reply, so it doesn't concern the
+			// pending requests
+			s.log().Debug("discarding netlink datagram", "err", err)
+
+		case err == syscall.ENOBUFS:
+			s.log().Warn("netlink receive buffer overflowed", "err", err)
+			s.resync()
+
+		default:
+			s.log().Warn("netlink receive failed", "err", err)
+			s.failPending(err)
 		}
 
-		msg, err := resp.nextNlMsg()
-		if err != nil {
-			return nil, err
+		s.lock.Lock()
+		if len(s.pending) == 0 {
+			s.reading = false
+			s.lock.Unlock()
+			return
 		}
-		if msg == nil {
-			return nil, fmt.Errorf("netlink response message missing")
+		s.lock.Unlock()
+	}
+}
+
+// Deliver an error to all outstanding requests.  They are
+// unregistered, so that the reader goroutine exits rather than
+// spinning on a broken socket.
+func (s *NetlinkSocket) failPending(err error) {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+
+	for _, p := range pending {
+		p.put(nlReply{err: err})
+	}
+}
+
+// The kernel dropped datagrams because the socket's receive buffer
+// was full, but the socket remains usable.  The kernel handles
+// requests as they are sent, and netlink preserves ordering, so a
+// request that has had no reply by the time the reply to a probe
+// sent now arrives has lost it.  Requests that have had replies
+// (e.g. dumps underway) are unaffected, because the kernel only
+// produces the rest of a dump as the socket is read.
+func (s *NetlinkSocket) resync() {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	s.lock.Lock()
+	reqs := make(map[uint32]*pendingRequest)
+	for seq, p := range s.pending {
+		if p.sent && !p.replied {
+			reqs[seq] = p
+		}
+	}
+
+	if len(reqs) == 0 {
+		s.lock.Unlock()
+		return
+	}
+
+	probe := NewNlMsgBuilder(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, syscall.NLMSG_NOOP)
+	data, seq := probe.Finish()
+	s.resyncSeq = seq
+	s.resyncReqs = reqs
+	s.lock.Unlock()
+
+	if err := s.send(data); err != nil {
+		s.log().Warn("netlink send failed", "err", err)
+		s.failPending(err)
+	}
+}
+
+// The reply to the resync probe has arrived, so fail the requests
+// that lost their replies
+func (s *NetlinkSocket) finishResync() {
+	s.lock.Lock()
+	var lost []*pendingRequest
+	for seq, p := range s.resyncReqs {
+		if s.pending[seq] == p && !p.replied {
+			delete(s.pending, seq)
+			lost = append(lost, p)
+		}
+	}
+	s.resyncSeq = 0
+	s.resyncReqs = nil
+	s.lock.Unlock()
+
+	for _, p := range lost {
+		p.put(nlReply{err: syscall.ENOBUFS})
+	}
+}
+
+func (s *NetlinkSocket) dispatchReplies(resp *NlMsgParser, b *recvBuffer) {
+	for {
+		msg, err := resp.nextNlMsg()
+		if msg == nil && err == nil {
+			return
 		}
 
-		h, err := msg.checkHeader(s, seq)
 		if err != nil {
-			return nil, err
+			// The rest of the datagram cannot be parsed,
+			// so we don't know who it was for.
+			s.log().Warn("malformed netlink reply", "err", err)
+			s.failPending(err)
+			return
 		}
-		if h == nil {
+
+		h := nlMsghdrAt(msg.data, msg.pos)
+		s.lock.Lock()
+		if s.resyncSeq != 0 && h.Seq == s.resyncSeq {
+			s.lock.Unlock()
+			s.finishResync()
 			continue
 		}
 
-		extra, err := resp.nextNlMsg()
-		if err != nil {
-			return nil, err
+		p := s.pending[h.Seq]
+		if p != nil {
+			p.replied = true
+			if p.isFinal(h) {
+				delete(s.pending, h.Seq)
+			}
 		}
-		if extra != nil {
-			return nil, fmt.Errorf("unexpected netlink message")
+		s.lock.Unlock()
+
+		if p == nil {
+			// This doesn't necessarily indicate an error.
+			// For example, if a RequestMulti was
+			// interrupted due to an error, we might still
+			// be getting response messages back, that we
+			// should simply discard.  On the other hand,
+			// unexpected sequence numbers might indicate
+			// bugs, so it is sometimes nice to see them in
+			// development.
+			s.logMsg("discarding netlink reply with unknown sequence number", msg.data, msg.pos)
+			continue
 		}
 
-		return msg, nil
+		s.logMsg("netlink reply", msg.data, msg.pos)
+		b.hold()
+		p.put(nlReply{msg: msg, buf: b})
 	}
 }
 
+// Some generic netlink operations always return a reply message (e.g
+// *_GET), others don't by default (e.g. *_NEW).  In the latter case,
+// NLM_F_ECHO forces a reply.  This is undocumented AFAICT.
+const RequestFlags = syscall.NLM_F_REQUEST | syscall.NLM_F_ECHO
+
+// Do a netlink request that yields a single response message.
+func (s *NetlinkSocket) Request(req *NlMsgBuilder) (*NlMsgParser, error) {
+	return s.RequestContext(context.Background(), req)
+}
+
+// As Request, but giving up when ctx is done.  A reply that arrives
+// afterwards is discarded.
+func (s *NetlinkSocket) RequestContext(ctx context.Context, req *NlMsgBuilder) (*NlMsgParser, error) {
+	p, seq, err := s.startRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer s.endRequest(seq)
+
+	r := p.take(ctx)
+	if r.err != nil {
+		return nil, r.err
+	}
+	defer r.release()
+
+	_, err = r.msg.checkHeader(s, p.req, p.attrsStart)
+	if err != nil {
+		s.log().Debug("netlink request failed", "seq", seq, "err", err)
+		return nil, err
+	}
+
+	// The caller may hold on to the reply, so copy it out of
+	// the receive buffer
+	return &NlMsgParser{data: append([]byte(nil), r.msg.data[r.msg.pos:]...)}, nil
+}
+
 const DumpFlags = syscall.NLM_F_DUMP | syscall.NLM_F_REQUEST
 
 // Do a netlink request that yield multiple response messages.
+// Concurrent dumps on the same socket are serialized, so the
+// consumer must not start another dump on it.  Each message is only
+// valid until the consumer returns.  If the dump was interrupted,
+// all of it is still passed to the consumer, but ErrDumpInterrupted
+// is returned at the end.
 func (s *NetlinkSocket) RequestMulti(req *NlMsgBuilder, consumer func(*NlMsgParser) error) error {
-	seq, err := s.send(req)
+	return s.RequestMultiContext(context.Background(), req, consumer)
+}
+
+// As RequestMulti, but giving up when ctx is done.
+func (s *NetlinkSocket) RequestMultiContext(ctx context.Context, req *NlMsgBuilder, consumer func(*NlMsgParser) error) error {
+	select {
+	case s.dumpSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p, seq, err := s.startRequest(req)
 	if err != nil {
+		<-s.dumpSem
 		return err
 	}
 
+	// Whether the kernel has finished the dump
+	finished := false
+	interrupted := false
+	defer func() {
+		if finished {
+			s.endRequest(seq)
+			<-s.dumpSem
+			return
+		}
+
+		// Until the kernel has sent the rest of an abandoned
+		// dump, another dump cannot start on the socket.
+		// Discard it in the background, so that we return
+		// promptly if ctx is done.
+		s.log().Debug("draining abandoned netlink dump", "seq", seq)
+		go func() {
+			s.drainDump(p)
+			s.endRequest(seq)
+			<-s.dumpSem
+		}()
+	}()
+
 	for {
-		resp, err := s.recv(0)
-		if err != nil {
-			return err
+		r := p.take(ctx)
+		if r.err != nil {
+			// Unless ctx is done, the socket is broken
+			// and no more replies will arrive.
+			finished = ctx.Err() == nil
+			return r.err
 		}
 
-		msg, err := resp.nextNlMsg()
+		h, err := r.msg.checkHeader(s, p.req, p.attrsStart)
 		if err != nil {
+			r.release()
+			s.log().Debug("netlink dump failed", "seq", seq, "err", err)
+			// An error response ends the dump
+			var nlerr NetlinkError
+			finished = errors.As(err, &nlerr)
 			return err
 		}
-		if msg == nil {
-			return fmt.Errorf("netlink response message missing")
+
+		if h.Flags&NLM_F_DUMP_INTR != 0 {
+			interrupted = true
 		}
 
-		for {
-			h, err := msg.checkHeader(s, seq)
-			if err != nil {
-				return err
+		if h.Type == syscall.NLMSG_DONE {
+			r.release()
+			finished = true
+			if interrupted {
+				s.log().Debug("netlink dump interrupted", "seq", seq)
+				return ErrDumpInterrupted
 			}
+			return nil
+		}
 
-			if h != nil {
-				if h.Type == syscall.NLMSG_DONE {
-					return nil
-				}
+		err = consumer(r.msg)
+		r.release()
+		if err != nil {
+			return err
+		}
+	}
+}
 
-				err = consumer(msg)
-				if err != nil {
-					return err
-				}
-			}
+func (s *NetlinkSocket) drainDump(p *pendingRequest) {
+	for {
+		r := p.take(context.Background())
+		if r.err != nil {
+			return
+		}
 
-			msg, err = resp.nextNlMsg()
-			if err != nil {
-				return err
-			}
-			if msg == nil {
-				break
-			}
+		h, err := r.msg.checkHeader(s, p.req, p.attrsStart)
+		r.release()
+		if err != nil || h.Type == syscall.NLMSG_DONE {
+			return
 		}
 	}
 }
@@ -0,0 +1,505 @@
+package odp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// These tests use rtnetlink, which unlike the openvswitch families
+// is always available and needs no privileges.
+
+func newGetLinkRequest(flags uint16, ifindex int32) *NlMsgBuilder {
+	req := NewNlMsgBuilder(flags, syscall.RTM_GETLINK)
+	pos := req.AlignGrow(syscall.NLMSG_ALIGNTO, syscall.SizeofIfInfomsg)
+	ifinfo := (*syscall.IfInfomsg)(unsafe.Pointer(&req.buf[pos]))
+	ifinfo.Family = syscall.AF_UNSPEC
+	ifinfo.Index = ifindex
+	return req
+}
+
+func countLinks(sock *NetlinkSocket) (int, error) {
+	n := 0
+	err := sock.RequestMulti(newGetLinkRequest(DumpFlags, 0), func(msg *NlMsgParser) error {
+		_, err := msg.ExpectNlMsghdr(syscall.RTM_NEWLINK)
+		n++
+		return err
+	})
+	return n, err
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	expect, err := countLinks(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			got, err := countLinks(sock)
+			if err == nil && got != expect {
+				t.Errorf("got %d links, expected %d", got, expect)
+			}
+			errs <- err
+		}()
+
+		go func() {
+			defer wg.Done()
+			// The loopback device always has ifindex 1
+			resp, err := sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+			if err == nil {
+				_, err = resp.ExpectNlMsghdr(syscall.RTM_NEWLINK)
+			}
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNestedRequest(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	// Make a request from within a dump consumer
+	err = sock.RequestMulti(newGetLinkRequest(DumpFlags, 0), func(msg *NlMsgParser) error {
+		_, err := sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonedDump(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	stop := fmt.Errorf("stop")
+	err = sock.RequestMulti(newGetLinkRequest(DumpFlags, 0), func(msg *NlMsgParser) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatal(err)
+	}
+
+	// The next dump must not see the remains of the first
+	_, err = countLinks(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = sock.RequestContext(ctx, newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// Cancel a dump part way through
+	ctx, cancel = context.WithCancel(context.Background())
+	err = sock.RequestMultiContext(ctx, newGetLinkRequest(DumpFlags, 0), func(msg *NlMsgParser) error {
+		cancel()
+		return nil
+	})
+	if err != nil && err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// The socket remains usable
+	_, err = countLinks(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWakesReceive(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		// Nothing sends to this socket, so this blocks
+		errs <- sock.Receive(func(*NlMsgParser) error { return nil })
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	sock.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive not woken by Close")
+	}
+}
+
+func TestRecvLargeDatagram(t *testing.T) {
+	a, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// Bigger than a page, and than the pooled receive buffers
+	msg := NewNlMsgBuilder(0, syscall.NLMSG_NOOP)
+	msg.Grow(recvBufferSize * 2)
+	data, _ := msg.Finish()
+
+	// Unicast between userspace sockets needs no privileges
+	err = a.conn.sendto(data, b.Pid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, buf, err := b.recv(a.Pid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.release()
+
+	if len(resp.data) != len(data) {
+		t.Fatal(len(resp.data))
+	}
+}
+
+func BenchmarkReceive(b *testing.B) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sock.Close()
+
+	// Receive only accepts datagrams from the kernel, so ask it
+	// for a message about the loopback device each time.  The
+	// reply is about the size of a typical upcall.
+	req, _ := newGetLinkRequest(syscall.NLM_F_REQUEST, 1).Finish()
+	consumer := func(msg *NlMsgParser) error {
+		_, err := msg.ExpectNlMsghdr(syscall.RTM_NEWLINK)
+		return err
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := sock.send(req); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := sock.Receive(consumer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDumpLinks(b *testing.B) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sock.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := countLinks(sock); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExtendedAck(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	// An over-long interface name fails policy validation
+	req := newGetLinkRequest(syscall.NLM_F_REQUEST, 0)
+	req.PutUint32Attr(syscall.IFLA_MTU, 0)
+	req.PutStringAttr(syscall.IFLA_IFNAME, strings.Repeat("x", 40))
+
+	_, err = sock.Request(req)
+	switch err := err.(type) {
+	case NetlinkExtendedError:
+		if len(err.AttrPath) != 1 || err.AttrPath[0] != syscall.IFLA_IFNAME {
+			t.Fatal(err)
+		}
+
+		if !IsNetlinkError(err, syscall.Errno(err.NetlinkError)) {
+			t.Fatal(err)
+		}
+
+	case NetlinkError:
+		t.Skip("kernel does not support extended ACKs")
+
+	default:
+		t.Fatal(err)
+	}
+}
+
+func TestAttrPath(t *testing.T) {
+	msg := NewNlMsgBuilder(0, 0)
+	msg.PutUint32Attr(1, 0)
+	var inner int
+	msg.PutNestedAttrs(2, func() {
+		msg.PutUint32Attr(3, 0)
+		msg.PutNestedAttrs(4, func() {
+			inner = msg.AlignGrow(syscall.NLA_ALIGNTO, 0)
+			msg.PutUint32Attr(5, 0)
+		})
+	})
+	msg.PutUint32Attr(6, 0)
+
+	start := msg.attrsStart
+	data, _ := msg.Finish()
+
+	path := attrPath(data, start, inner)
+	if len(path) != 3 || path[0] != 2 || path[1] != 4 || path[2] != 5 {
+		t.Fatal(path)
+	}
+
+	// An offset within a non-nested attribute gives just that
+	// attribute
+	path = attrPath(data, start, start+syscall.SizeofNlAttr)
+	if len(path) != 1 || path[0] != 1 {
+		t.Fatal(path)
+	}
+
+	path = attrPath(data, start, len(data)-syscall.SizeofNlAttr-4)
+	if len(path) != 1 || path[0] != 6 {
+		t.Fatal(path)
+	}
+
+	if attrPath(data, start, 0) != nil {
+		t.Fatal()
+	}
+
+	// Without the position of the attributes, there is no path
+	if attrPath(data, 0, inner) != nil {
+		t.Fatal()
+	}
+}
+
+func TestLogger(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	var buf bytes.Buffer
+	sock.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	_, err = sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=\"netlink request\"") || !strings.Contains(out, "msg=\"netlink reply\"") {
+		t.Fatal(out)
+	}
+
+	// Nothing is logged once the logger is removed
+	sock.SetLogger(nil)
+	buf.Reset()
+	if _, err := countLinks(sock); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestStrayDatagram(t *testing.T) {
+	a, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	msg := NewNlMsgBuilder(0, syscall.NLMSG_NOOP)
+	data, _ := msg.Finish()
+	err = a.conn.sendto(data, b.Pid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The datagram from another socket is discarded, rather
+	// than failing the request
+	_, err = b.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderExits(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	_, err = sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader goroutine exits without waiting for another
+	// datagram
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sock.lock.Lock()
+		reading := sock.reading
+		sock.lock.Unlock()
+		if !reading {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("reader goroutine still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A Transport that drops datagrams as if the socket's receive buffer
+// overflowed
+type overflowingTransport struct {
+	Transport
+	drop int32
+}
+
+func (t *overflowingTransport) Receive() ([]byte, error) {
+	data, err := t.Transport.Receive()
+	if err == nil && atomic.AddInt32(&t.drop, -1) >= 0 {
+		return nil, syscall.ENOBUFS
+	}
+	return data, err
+}
+
+func TestReceiveBufferOverflow(t *testing.T) {
+	ot := &overflowingTransport{Transport: NewFakeKernel().NewTransport(), drop: 1}
+	sock := NewTransportNetlinkSocket(ot)
+	defer sock.Close()
+
+	// The request whose reply was dropped fails
+	_, err := sock.LookupGenlFamily(familyNames[DATAPATH])
+	if !errors.Is(err, syscall.ENOBUFS) {
+		t.Fatal(err)
+	}
+
+	// But the socket remains usable
+	_, err = sock.LookupGenlFamily(familyNames[DATAPATH])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A Transport that drops the reply to the first request, as if the
+// socket's receive buffer overflowed, before the Send of that request
+// returns
+type sendRaceTransport struct {
+	Transport
+	sends   int32
+	drops   int32
+	dropped chan struct{}
+}
+
+func (t *sendRaceTransport) Send(data []byte) error {
+	err := t.Transport.Send(data)
+	if atomic.AddInt32(&t.sends, 1) == 1 {
+		// Give the reader a chance to handle the overflow
+		// while the send is still in progress
+		<-t.dropped
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func (t *sendRaceTransport) Receive() ([]byte, error) {
+	data, err := t.Transport.Receive()
+	if err == nil && atomic.AddInt32(&t.drops, 1) == 1 {
+		close(t.dropped)
+		return nil, syscall.ENOBUFS
+	}
+	return data, err
+}
+
+func TestReceiveBufferOverflowDuringSend(t *testing.T) {
+	st := &sendRaceTransport{
+		Transport: NewFakeKernel().NewTransport(),
+		dropped:   make(chan struct{}),
+	}
+	sock := NewTransportNetlinkSocket(st)
+	defer sock.Close()
+
+	// The request fails, rather than waiting forever for the
+	// dropped reply
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := sock.LookupGenlFamilyContext(ctx, familyNames[DATAPATH])
+	if !errors.Is(err, syscall.ENOBUFS) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,178 @@
+package odp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Netlink traffic can be recorded in pcap format, using the link
+// type of the Linux nlmon device, so that Wireshark can dissect it.
+// Each packet starts with a cooked header in the style of
+// LINKTYPE_LINUX_SLL.
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNanos = 0xa1b23c4d
+	pcapSnapLen    = 262144
+
+	LINKTYPE_NETLINK = 253
+	ARPHRD_NETLINK   = 824
+
+	// sll_pkttype values
+	PACKET_HOST     = 0
+	PACKET_OUTGOING = 4
+
+	sizeofPcapHeader       = 24
+	sizeofPcapRecordHeader = 16
+	sizeofCookedHeader     = 16
+)
+
+// Writes netlink datagrams to a pcap file
+type PcapWriter struct {
+	lock     sync.Mutex
+	w        io.Writer
+	protocol uint16
+	err      error
+}
+
+// Start a pcap file for traffic on a netlink socket of the given
+// protocol (e.g. syscall.NETLINK_GENERIC).
+func NewPcapWriter(w io.Writer, protocol int) (*PcapWriter, error) {
+	var h [sizeofPcapHeader]byte
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], LINKTYPE_NETLINK)
+
+	if _, err := w.Write(h[:]); err != nil {
+		return nil, err
+	}
+
+	return &PcapWriter{w: w, protocol: uint16(protocol)}, nil
+}
+
+// Write a datagram, sent to the kernel if sent is true, or else
+// received from it.
+func (pw *PcapWriter) WritePacket(sent bool, data []byte) error {
+	var h [sizeofPcapRecordHeader + sizeofCookedHeader]byte
+	now := time.Now()
+	l := uint32(sizeofCookedHeader + len(data))
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], l)
+	binary.LittleEndian.PutUint32(h[12:], l)
+
+	// The cooked header fields are in network byte order
+	ch := h[sizeofPcapRecordHeader:]
+	pkttype := uint16(PACKET_HOST)
+	if sent {
+		pkttype = PACKET_OUTGOING
+	}
+	binary.BigEndian.PutUint16(ch[0:], pkttype)
+	binary.BigEndian.PutUint16(ch[2:], ARPHRD_NETLINK)
+	binary.BigEndian.PutUint16(ch[14:], pw.protocol)
+
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	if pw.err != nil {
+		return pw.err
+	}
+
+	if _, pw.err = pw.w.Write(h[:]); pw.err == nil {
+		_, pw.err = pw.w.Write(data)
+	}
+
+	return pw.err
+}
+
+// Write a datagram, for use with NetlinkSocket.SetTracer.  Errors
+// are reported by Err.
+func (pw *PcapWriter) Trace(sent bool, data []byte) {
+	pw.WritePacket(sent, data)
+}
+
+// The first error encountered while writing, if any
+func (pw *PcapWriter) Err() error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	return pw.err
+}
+
+// Reads netlink datagrams from a pcap file, such as one written by
+// a PcapWriter or captured from an nlmon device.
+type PcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var h [sizeofPcapHeader]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case isPcapMagic(binary.LittleEndian.Uint32(h[0:])):
+		order = binary.LittleEndian
+	case isPcapMagic(binary.BigEndian.Uint32(h[0:])):
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap file")
+	}
+
+	if linktype := order.Uint32(h[20:]); linktype != LINKTYPE_NETLINK {
+		return nil, fmt.Errorf("pcap file has link type %d, expected %d", linktype, LINKTYPE_NETLINK)
+	}
+
+	return &PcapReader{r: r, order: order}, nil
+}
+
+func isPcapMagic(magic uint32) bool {
+	return magic == pcapMagic || magic == pcapMagicNanos
+}
+
+// Read the next datagram, returning whether it was sent to the
+// kernel, the netlink protocol, and the datagram itself.  Returns
+// io.EOF at the end of the file.
+func (pr *PcapReader) ReadPacket() (sent bool, protocol int, data []byte, err error) {
+	var h [sizeofPcapRecordHeader]byte
+	if _, err = io.ReadFull(pr.r, h[:]); err != nil {
+		return
+	}
+
+	l := pr.order.Uint32(h[8:])
+	if l < sizeofCookedHeader || l > pcapSnapLen {
+		err = fmt.Errorf("bad pcap record length %d", l)
+		return
+	}
+
+	if orig := pr.order.Uint32(h[12:]); orig != l {
+		err = fmt.Errorf("truncated pcap record (%d of %d bytes)", l, orig)
+		return
+	}
+
+	data = make([]byte, l)
+	if _, err = io.ReadFull(pr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	ch := data[:sizeofCookedHeader]
+	if hatype := binary.BigEndian.Uint16(ch[2:]); hatype != ARPHRD_NETLINK {
+		err = fmt.Errorf("pcap record has ARP hardware type %d, expected %d", hatype, ARPHRD_NETLINK)
+		return
+	}
+
+	sent = binary.BigEndian.Uint16(ch[0:]) == PACKET_OUTGOING
+	protocol = int(binary.BigEndian.Uint16(ch[14:]))
+	data = data[sizeofCookedHeader:]
+	return
+}
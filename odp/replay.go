@@ -0,0 +1,167 @@
+package odp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+type recordedPacket struct {
+	sent bool
+	data []byte
+}
+
+// Stands in for the kernel by replaying recorded traffic.  The
+// requests must be sent in the order they were recorded, and must
+// match the recording except for their sequence numbers.  The
+// sequence numbers in replies are mapped to those of the actual
+// requests.
+type replayTransport struct {
+	lock    sync.Mutex
+	cond    sync.Cond
+	packets []recordedPacket
+	closed  bool
+	pid     uint32
+
+	// Maps recorded sequence numbers to actual ones
+	seqs map[uint32]uint32
+}
+
+// Open a NetlinkSocket that replays the traffic in a pcap file
+// written by a PcapWriter, rather than talking to the kernel.  This
+// needs no privileges, so it allows tests to use traffic recorded
+// from a real kernel.  Requests must be made in the same order as
+// when the traffic was recorded, and must be identical apart from
+// their sequence numbers; otherwise sending them fails.  Once the
+// recording is exhausted, receiving fails with io.EOF.
+func NewReplayNetlinkSocket(pr *PcapReader) (*NetlinkSocket, error) {
+	c := &replayTransport{seqs: make(map[uint32]uint32)}
+	c.cond.L = &c.lock
+
+	for {
+		sent, _, data, err := pr.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.packets = append(c.packets, recordedPacket{sent: sent, data: data})
+	}
+
+	// Replies are addressed to the recording socket's port id,
+	// so the replaying socket must have the same one.
+	for _, p := range c.packets {
+		if !p.sent && len(p.data) >= syscall.SizeofNlMsghdr {
+			c.pid = nlMsghdrAt(p.data, 0).Pid
+			break
+		}
+	}
+
+	return NewTransportNetlinkSocket(c), nil
+}
+
+// Apply f to the header of each message in a datagram
+func forEachNlMsghdr(data []byte, f func(h *syscall.NlMsghdr)) {
+	for pos := 0; len(data)-pos >= syscall.SizeofNlMsghdr; {
+		h := nlMsghdrAt(data, pos)
+		if int(h.Len) < syscall.SizeofNlMsghdr || int(h.Len) > len(data)-pos {
+			return
+		}
+
+		f(h)
+		pos = align(pos+int(h.Len), syscall.NLMSG_ALIGNTO)
+	}
+}
+
+func (c *replayTransport) Send(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return os.ErrClosed
+	}
+
+	if len(c.packets) == 0 || !c.packets[0].sent {
+		return fmt.Errorf("unexpected request during replay of recorded netlink traffic")
+	}
+
+	// Compare with the recorded request, ignoring sequence
+	// numbers
+	recorded := append([]byte(nil), c.packets[0].data...)
+	var seqs []uint32
+	forEachNlMsghdr(data, func(h *syscall.NlMsghdr) {
+		seqs = append(seqs, h.Seq)
+	})
+
+	var recordedSeqs []uint32
+	forEachNlMsghdr(recorded, func(h *syscall.NlMsghdr) {
+		if len(recordedSeqs) < len(seqs) {
+			recordedSeqs = append(recordedSeqs, h.Seq)
+			h.Seq = seqs[len(recordedSeqs)-1]
+		}
+	})
+
+	if !bytes.Equal(data, recorded) {
+		return fmt.Errorf("request differs from recorded netlink traffic")
+	}
+
+	for i, seq := range recordedSeqs {
+		c.seqs[seq] = seqs[i]
+	}
+
+	c.packets = c.packets[1:]
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *replayTransport) Receive() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		if c.closed {
+			return nil, os.ErrClosed
+		}
+
+		if len(c.packets) == 0 {
+			return nil, io.EOF
+		}
+
+		if !c.packets[0].sent {
+			break
+		}
+
+		// The next reply follows a request that has not been
+		// sent yet
+		c.cond.Wait()
+	}
+
+	data := append([]byte(nil), c.packets[0].data...)
+	c.packets = c.packets[1:]
+
+	forEachNlMsghdr(data, func(h *syscall.NlMsghdr) {
+		if seq, ok := c.seqs[h.Seq]; ok {
+			h.Seq = seq
+		}
+	})
+
+	return data, nil
+}
+
+func (c *replayTransport) Pid() uint32 {
+	return c.pid
+}
+
+func (c *replayTransport) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,128 @@
+package odp
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf, syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock.SetTracer(pw.Trace)
+
+	// The loopback device always has ifindex 1
+	lo, err := sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := countLinks(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock.Close()
+	if err := pw.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	recording := buf.Bytes()
+	replay := func() *NetlinkSocket {
+		pr, err := NewPcapReader(bytes.NewReader(recording))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sock, err := NewReplayNetlinkSocket(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sock
+	}
+
+	sock = replay()
+	defer sock.Close()
+
+	lo2, err := sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the sequence numbers differ
+	if !bytes.Equal(lo.data[syscall.NLMSG_HDRLEN:], lo2.data[syscall.NLMSG_HDRLEN:]) {
+		t.Fatal("replayed reply differs")
+	}
+
+	if n, err := countLinks(sock); err != nil || n != links {
+		t.Fatal(n, err)
+	}
+
+	// The recording is exhausted
+	_, err = sock.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 1))
+	if err == nil {
+		t.Fatal()
+	}
+
+	// A request that differs from the recording fails
+	sock2 := replay()
+	defer sock2.Close()
+
+	_, err = sock2.Request(newGetLinkRequest(syscall.NLM_F_REQUEST, 2))
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestPcapFormat(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf, syscall.NETLINK_GENERIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pw.WritePacket(true, []byte{1, 2, 3, 4})
+	pw.WritePacket(false, []byte{5, 6, 7, 8})
+
+	data := buf.Bytes()
+	if len(data) != sizeofPcapHeader+2*(sizeofPcapRecordHeader+sizeofCookedHeader+4) {
+		t.Fatal(len(data))
+	}
+
+	// The cooked header of the first packet: outgoing, netlink
+	// hardware type, and the protocol in network byte order
+	ch := data[sizeofPcapHeader+sizeofPcapRecordHeader:][:sizeofCookedHeader]
+	if !bytes.Equal(ch, []byte{0, 4, 3, 0x38, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 16}) {
+		t.Fatal(ch)
+	}
+
+	pr, err := NewPcapReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []recordedPacket{{true, []byte{1, 2, 3, 4}}, {false, []byte{5, 6, 7, 8}}} {
+		sent, protocol, data, err := pr.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sent != expect.sent || protocol != syscall.NETLINK_GENERIC || !bytes.Equal(data, expect.data) {
+			t.Fatal(sent, protocol, data)
+		}
+	}
+
+	if _, _, _, err := pr.ReadPacket(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
@@ -10,6 +10,34 @@ type GenlMsghdr struct {
 
 const SizeofGenlMsghdr = 4
 
+// Netlink message flags missing from the syscall package
+const (
+	// Set on dump replies when the dump was interrupted by
+	// changes, so it may be inconsistent
+	NLM_F_DUMP_INTR = 0x10
+
+	// Set on error replies when the original request payload
+	// is not included
+	NLM_F_CAPPED = 0x100
+
+	// Set on error replies carrying extended ACK attributes
+	NLM_F_ACK_TLVS = 0x200
+)
+
+// The flag bits in the nlattr type field
+const NLA_TYPE_MASK = ^uint16(syscall.NLA_F_NESTED | syscall.NLA_F_NET_BYTEORDER)
+
+const (
+	SOL_NETLINK     = 270
+	NETLINK_EXT_ACK = 11
+)
+
+const ( // nlmsgerr_attrs
+	NLMSGERR_ATTR_UNUSED = 0
+	NLMSGERR_ATTR_MSG    = 1
+	NLMSGERR_ATTR_OFFS   = 2
+)
+
 // reserved static generic netlink identifiers:
 const (
 	GENL_ID_GENERATE  = 0
@@ -51,6 +79,8 @@ const (
 	OVS_DATAPATH_VERSION = 2
 	OVS_VPORT_VERSION    = 1
 	OVS_FLOW_VERSION     = 1
+	OVS_METER_VERSION    = 1
+	OVS_CT_LIMIT_VERSION = 1
 )
 
 const ( // ovs_datapath_cmd
@@ -62,12 +92,16 @@ const ( // ovs_datapath_cmd
 )
 
 const ( // ovs_datapath_attr
-	OVS_DP_ATTR_UNSPEC         = 0
-	OVS_DP_ATTR_NAME           = 1
-	OVS_DP_ATTR_UPCALL_PID     = 2
-	OVS_DP_ATTR_STATS          = 3
-	OVS_DP_ATTR_MEGAFLOW_STATS = 4
-	OVS_DP_ATTR_USER_FEATURES  = 5
+	OVS_DP_ATTR_UNSPEC           = 0
+	OVS_DP_ATTR_NAME             = 1
+	OVS_DP_ATTR_UPCALL_PID       = 2
+	OVS_DP_ATTR_STATS            = 3
+	OVS_DP_ATTR_MEGAFLOW_STATS   = 4
+	OVS_DP_ATTR_USER_FEATURES    = 5
+	OVS_DP_ATTR_PAD              = 6
+	OVS_DP_ATTR_MASKS_CACHE_SIZE = 7
+	OVS_DP_ATTR_PER_CPU_PIDS     = 8
+	OVS_DP_ATTR_IFINDEX          = 9
 )
 
 const ( // ovs_vport_cmd
@@ -86,6 +120,9 @@ const ( // ovs_vport_attr
 	OVS_VPORT_ATTR_OPTIONS    = 4
 	OVS_VPORT_ATTR_UPCALL_PID = 5
 	OVS_VPORT_ATTR_STATS      = 6
+	OVS_VPORT_ATTR_PAD        = 7
+	OVS_VPORT_ATTR_IFINDEX    = 8
+	OVS_VPORT_ATTR_NETNSID    = 9
 )
 
 const ( // ovs_vport_type
@@ -94,11 +131,18 @@ const ( // ovs_vport_type
 	OVS_VPORT_TYPE_INTERNAL = 2
 	OVS_VPORT_TYPE_GRE      = 3
 	OVS_VPORT_TYPE_VXLAN    = 4
+	OVS_VPORT_TYPE_GENEVE   = 5
 )
 
 const ( // OVS_VPORT_ATTR_OPTIONS attributes for tunnels
-	OVS_TUNNEL_ATTR_UNSPEC   = 0
-	OVS_TUNNEL_ATTR_DST_PORT = 1
+	OVS_TUNNEL_ATTR_UNSPEC    = 0
+	OVS_TUNNEL_ATTR_DST_PORT  = 1
+	OVS_TUNNEL_ATTR_EXTENSION = 2
+)
+
+const ( // OVS_TUNNEL_ATTR_EXTENSION attributes for VXLAN
+	OVS_VXLAN_EXT_UNSPEC = 0
+	OVS_VXLAN_EXT_GBP    = 1
 )
 
 const ( // ovs_flow_cmd
@@ -162,16 +206,156 @@ type OvsKeyEthernet struct {
 const SizeofOvsKeyEthernet = 12
 
 const ( // ovs_action_attr
-	OVS_ACTION_ATTR_UNSPEC    = 0
-	OVS_ACTION_ATTR_OUTPUT    = 1
-	OVS_ACTION_ATTR_USERSPACE = 2
-	OVS_ACTION_ATTR_SET       = 3
-	OVS_ACTION_ATTR_PUSH_VLAN = 4
-	OVS_ACTION_ATTR_POP_VLAN  = 5
-	OVS_ACTION_ATTR_SAMPLE    = 6
+	OVS_ACTION_ATTR_UNSPEC        = 0
+	OVS_ACTION_ATTR_OUTPUT        = 1
+	OVS_ACTION_ATTR_USERSPACE     = 2
+	OVS_ACTION_ATTR_SET           = 3
+	OVS_ACTION_ATTR_PUSH_VLAN     = 4
+	OVS_ACTION_ATTR_POP_VLAN      = 5
+	OVS_ACTION_ATTR_SAMPLE        = 6
+	OVS_ACTION_ATTR_RECIRC        = 7
+	OVS_ACTION_ATTR_HASH          = 8
+	OVS_ACTION_ATTR_PUSH_MPLS     = 9
+	OVS_ACTION_ATTR_POP_MPLS      = 10
+	OVS_ACTION_ATTR_SET_MASKED    = 11
+	OVS_ACTION_ATTR_CT            = 12
+	OVS_ACTION_ATTR_TRUNC         = 13
+	OVS_ACTION_ATTR_PUSH_ETH      = 14
+	OVS_ACTION_ATTR_POP_ETH       = 15
+	OVS_ACTION_ATTR_CT_CLEAR      = 16
+	OVS_ACTION_ATTR_PUSH_NSH      = 17
+	OVS_ACTION_ATTR_POP_NSH       = 18
+	OVS_ACTION_ATTR_METER         = 19
+	OVS_ACTION_ATTR_CLONE         = 20
+	OVS_ACTION_ATTR_CHECK_PKT_LEN = 21
+)
+
+const ( // ovs_ct_attr
+	OVS_CT_ATTR_UNSPEC       = 0
+	OVS_CT_ATTR_COMMIT       = 1
+	OVS_CT_ATTR_ZONE         = 2
+	OVS_CT_ATTR_MARK         = 3
+	OVS_CT_ATTR_LABELS       = 4
+	OVS_CT_ATTR_HELPER       = 5
+	OVS_CT_ATTR_NAT          = 6
+	OVS_CT_ATTR_FORCE_COMMIT = 7
+	OVS_CT_ATTR_EVENTMASK    = 8
+	OVS_CT_ATTR_TIMEOUT      = 9
+)
+
+const ( // ovs_nat_attr
+	OVS_NAT_ATTR_UNSPEC       = 0
+	OVS_NAT_ATTR_SRC          = 1
+	OVS_NAT_ATTR_DST          = 2
+	OVS_NAT_ATTR_IP_MIN       = 3
+	OVS_NAT_ATTR_IP_MAX       = 4
+	OVS_NAT_ATTR_PROTO_MIN    = 5
+	OVS_NAT_ATTR_PROTO_MAX    = 6
+	OVS_NAT_ATTR_PERSISTENT   = 7
+	OVS_NAT_ATTR_PROTO_HASH   = 8
+	OVS_NAT_ATTR_PROTO_RANDOM = 9
+)
+
+const OVS_CT_LABELS_LEN = 16
+
+const ( // ovs_check_pkt_len_attr
+	OVS_CHECK_PKT_LEN_ATTR_UNSPEC                = 0
+	OVS_CHECK_PKT_LEN_ATTR_PKT_LEN               = 1
+	OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_GREATER    = 2
+	OVS_CHECK_PKT_LEN_ATTR_ACTIONS_IF_LESS_EQUAL = 3
+)
+
+const ( // ovs_packet_cmd
+	OVS_PACKET_CMD_UNSPEC  = 0
+	OVS_PACKET_CMD_MISS    = 1
+	OVS_PACKET_CMD_ACTION  = 2
+	OVS_PACKET_CMD_EXECUTE = 3
+)
+
+const ( // ovs_packet_attr
+	OVS_PACKET_ATTR_UNSPEC         = 0
+	OVS_PACKET_ATTR_PACKET         = 1
+	OVS_PACKET_ATTR_KEY            = 2
+	OVS_PACKET_ATTR_ACTIONS        = 3
+	OVS_PACKET_ATTR_USERDATA       = 4
+	OVS_PACKET_ATTR_EGRESS_TUN_KEY = 5
+	OVS_PACKET_ATTR_UNUSED1        = 6
+	OVS_PACKET_ATTR_UNUSED2        = 7
+	OVS_PACKET_ATTR_PROBE          = 8
+	OVS_PACKET_ATTR_MRU            = 9
+	OVS_PACKET_ATTR_LEN            = 10
+	OVS_PACKET_ATTR_HASH           = 11
 )
 
 const (
-	OVS_DP_F_UNALIGNED  = 1
-	OVS_DP_F_VPORT_PIDS = 2
+	OVS_DP_F_UNALIGNED               = 1
+	OVS_DP_F_VPORT_PIDS              = 2
+	OVS_DP_F_TC_RECIRC_SHARING       = 4
+	OVS_DP_F_DISPATCH_UPCALL_PER_CPU = 8
+)
+
+// Port number of the datapath's local (internal) vport
+const OVSP_LOCAL = 0
+
+type OvsFlowStats struct {
+	NPackets uint64
+	NBytes   uint64
+}
+
+const SizeofOvsFlowStats = 16
+
+const ( // ovs_meter_cmd
+	OVS_METER_CMD_UNSPEC   = 0
+	OVS_METER_CMD_FEATURES = 1
+	OVS_METER_CMD_SET      = 2
+	OVS_METER_CMD_DEL      = 3
+	OVS_METER_CMD_GET      = 4
+)
+
+const ( // ovs_meter_attr
+	OVS_METER_ATTR_UNSPEC     = 0
+	OVS_METER_ATTR_ID         = 1
+	OVS_METER_ATTR_KBPS       = 2
+	OVS_METER_ATTR_STATS      = 3
+	OVS_METER_ATTR_BANDS      = 4
+	OVS_METER_ATTR_MAX_METERS = 5
+	OVS_METER_ATTR_MAX_BANDS  = 6
+	OVS_METER_ATTR_PAD        = 7
+	OVS_METER_ATTR_USED       = 8
+	OVS_METER_ATTR_CLEAR      = 9
+)
+
+const ( // ovs_band_attr
+	OVS_BAND_ATTR_UNSPEC = 0
+	OVS_BAND_ATTR_TYPE   = 1
+	OVS_BAND_ATTR_RATE   = 2
+	OVS_BAND_ATTR_BURST  = 3
+	OVS_BAND_ATTR_STATS  = 4
+)
+
+const ( // ovs_meter_band_type
+	OVS_METER_BAND_TYPE_UNSPEC = 0
+	OVS_METER_BAND_TYPE_DROP   = 1
 )
+
+const ( // ovs_ct_limit_cmd
+	OVS_CT_LIMIT_CMD_UNSPEC = 0
+	OVS_CT_LIMIT_CMD_SET    = 1
+	OVS_CT_LIMIT_CMD_DEL    = 2
+	OVS_CT_LIMIT_CMD_GET    = 3
+)
+
+const ( // ovs_ct_limit_attr
+	OVS_CT_LIMIT_ATTR_UNSPEC     = 0
+	OVS_CT_LIMIT_ATTR_ZONE_LIMIT = 1
+)
+
+const OVS_ZONE_LIMIT_DEFAULT_ZONE = -1
+
+type OvsZoneLimit struct {
+	ZoneId int32
+	Limit  uint32
+	Count  uint32
+}
+
+const SizeofOvsZoneLimit = 12
@@ -13,6 +13,10 @@ func uint32At(data []byte, pos int) *uint32 {
 	return (*uint32)(unsafe.Pointer(&data[pos]))
 }
 
+func uint64At(data []byte, pos int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&data[pos]))
+}
+
 func nlMsghdrAt(data []byte, pos int) *syscall.NlMsghdr {
 	return (*syscall.NlMsghdr)(unsafe.Pointer(&data[pos]))
 }
@@ -36,3 +40,11 @@ func ovsHeaderAt(data []byte, pos int) *OvsHeader {
 func ovsKeyEthernetAt(data []byte, pos int) *OvsKeyEthernet {
 	return (*OvsKeyEthernet)(unsafe.Pointer(&data[pos]))
 }
+
+func ovsFlowStatsAt(data []byte, pos int) *OvsFlowStats {
+	return (*OvsFlowStats)(unsafe.Pointer(&data[pos]))
+}
+
+func ovsZoneLimitAt(data []byte, pos int) *OvsZoneLimit {
+	return (*OvsZoneLimit)(unsafe.Pointer(&data[pos]))
+}
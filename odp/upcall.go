@@ -0,0 +1,130 @@
+package odp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A set of netlink sockets for receiving upcalls from a datapath,
+// one per CPU.
+type UpcallSockets struct {
+	Socks []*NetlinkSocket
+
+	// True if the datapath dispatches upcalls according to the
+	// CPU that handled the packet.  Otherwise, the kernel does
+	// not support per-CPU dispatch, and the sockets are instead
+	// associated with each vport; vports created later should be
+	// given Pids() in VportOptions.UpcallPids.
+	PerCPU bool
+}
+
+func (us *UpcallSockets) Pids() []uint32 {
+	pids := make([]uint32, len(us.Socks))
+	for i, sock := range us.Socks {
+		pids[i] = sock.Pid()
+	}
+	return pids
+}
+
+func (us *UpcallSockets) Close() error {
+	var res error
+	for _, sock := range us.Socks {
+		if err := sock.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	us.Socks = nil
+	return res
+}
+
+// The kernel picks the per-CPU upcall pid by CPU id, which may be
+// beyond the CPUs this process is allowed to run on, so this counts
+// all the possible CPUs rather than using runtime.NumCPU.
+func possibleCPUs() int {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	n, err := parseCPUList(strings.TrimSpace(string(data)))
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	return n
+}
+
+// Parse a kernel CPU list such as "0-3,8", returning one more than
+// the highest CPU id in it.
+func parseCPUList(s string) (int, error) {
+	n := 0
+	for _, r := range strings.Split(s, ",") {
+		lo, hi, ranged := strings.Cut(r, "-")
+		if !ranged {
+			hi = lo
+		}
+
+		first, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU list \"%s\"", s)
+		}
+
+		last, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || last < first {
+			return 0, fmt.Errorf("invalid CPU list \"%s\"", s)
+		}
+
+		if int(last) >= n {
+			n = int(last) + 1
+		}
+	}
+
+	return n, nil
+}
+
+// Open one upcall socket per possible CPU, and direct the datapath's upcalls
+// to them.  On kernels without per-CPU dispatch, this falls back to
+// setting the sockets as the upcall pids of the datapath's existing
+// vports.
+func (dp DatapathHandle) OpenUpcallSockets() (*UpcallSockets, error) {
+	us := &UpcallSockets{}
+
+	for i := possibleCPUs(); i > 0; i-- {
+		sock, err := dp.dpif.openSocket()
+		if err != nil {
+			us.Close()
+			return nil, err
+		}
+		us.Socks = append(us.Socks, sock)
+	}
+
+	err := dp.SetPerCPUUpcallPids(us.Pids())
+	if err == nil {
+		us.PerCPU = true
+		return us, nil
+	}
+
+	if !errors.Is(err, ErrNoPerCPUUpcalls) {
+		us.Close()
+		return nil, err
+	}
+
+	vports, err := dp.EnumerateVports()
+	if err != nil {
+		us.Close()
+		return nil, err
+	}
+
+	for _, vport := range vports {
+		if err := vport.Handle.SetUpcallPids(us.Pids()); err != nil {
+			us.Close()
+			return nil, err
+		}
+	}
+
+	return us, nil
+}
@@ -1,8 +1,9 @@
 package odp
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"syscall"
 )
 
 type VportSpec interface {
@@ -56,6 +57,9 @@ func NewInternalVportSpec(name string) VportSpec {
 type VxlanVportSpec struct {
 	VportSpecBase
 	DestPort uint16
+
+	// Enable the Group Based Policy extension
+	Gbp bool
 }
 
 func (VxlanVportSpec) TypeName() string {
@@ -68,10 +72,20 @@ func (VxlanVportSpec) typeId() uint32 {
 
 func (v VxlanVportSpec) optionNlAttrs(req *NlMsgBuilder) {
 	req.PutUint16Attr(OVS_TUNNEL_ATTR_DST_PORT, v.DestPort)
+
+	if v.Gbp {
+		req.PutNestedAttrs(OVS_TUNNEL_ATTR_EXTENSION, func() {
+			req.PutEmptyAttr(OVS_VXLAN_EXT_GBP)
+		})
+	}
 }
 
 func NewVxlanVportSpec(name string, destPort uint16) VportSpec {
-	return VxlanVportSpec{VportSpecBase{name}, destPort}
+	return VxlanVportSpec{VportSpecBase: VportSpecBase{name}, DestPort: destPort}
+}
+
+func NewVxlanGbpVportSpec(name string, destPort uint16) VportSpec {
+	return VxlanVportSpec{VportSpecBase: VportSpecBase{name}, DestPort: destPort, Gbp: true}
 }
 
 func parseVxlanVportSpec(name string, opts Attrs) (VportSpec, error) {
@@ -80,7 +94,97 @@ func parseVxlanVportSpec(name string, opts Attrs) (VportSpec, error) {
 		return nil, err
 	}
 
-	return VxlanVportSpec{VportSpecBase{name}, destPort}, nil
+	res := VxlanVportSpec{VportSpecBase: VportSpecBase{name}, DestPort: destPort}
+
+	exts, err := opts.GetNestedAttrs(OVS_TUNNEL_ATTR_EXTENSION, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if exts != nil {
+		res.Gbp, err = exts.GetEmpty(OVS_VXLAN_EXT_GBP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+type GeneveVportSpec struct {
+	VportSpecBase
+	DestPort uint16
+}
+
+func (GeneveVportSpec) TypeName() string {
+	return "geneve"
+}
+
+func (GeneveVportSpec) typeId() uint32 {
+	return OVS_VPORT_TYPE_GENEVE
+}
+
+func (v GeneveVportSpec) optionNlAttrs(req *NlMsgBuilder) {
+	req.PutUint16Attr(OVS_TUNNEL_ATTR_DST_PORT, v.DestPort)
+}
+
+func NewGeneveVportSpec(name string, destPort uint16) VportSpec {
+	return GeneveVportSpec{VportSpecBase{name}, destPort}
+}
+
+func parseGeneveVportSpec(name string, opts Attrs) (VportSpec, error) {
+	destPort, err := opts.GetUint16(OVS_TUNNEL_ATTR_DST_PORT)
+	if err != nil {
+		return nil, err
+	}
+
+	return GeneveVportSpec{VportSpecBase{name}, destPort}, nil
+}
+
+type GreVportSpec struct {
+	VportSpecBase
+}
+
+func (GreVportSpec) TypeName() string {
+	return "gre"
+}
+
+func (GreVportSpec) typeId() uint32 {
+	return OVS_VPORT_TYPE_GRE
+}
+
+func (GreVportSpec) optionNlAttrs(req *NlMsgBuilder) {
+}
+
+func NewGreVportSpec(name string) VportSpec {
+	return GreVportSpec{VportSpecBase{name}}
+}
+
+// A GenericVportSpec describes a vport of a type this package
+// doesn't otherwise know about.  The options are kept as the raw
+// contents of the OVS_VPORT_ATTR_OPTIONS attribute, so that the vport
+// can be re-created verbatim.
+type GenericVportSpec struct {
+	VportSpecBase
+	Type    uint32
+	Options []byte
+}
+
+func (g GenericVportSpec) TypeName() string {
+	return fmt.Sprintf("type-%d", g.Type)
+}
+
+func (g GenericVportSpec) typeId() uint32 {
+	return g.Type
+}
+
+func (g GenericVportSpec) optionNlAttrs(req *NlMsgBuilder) {
+	pos := req.Grow(uintptr(len(g.Options)))
+	copy(req.buf[pos:], g.Options)
+}
+
+func NewGenericVportSpec(name string, typ uint32, options []byte) VportSpec {
+	return GenericVportSpec{VportSpecBase{name}, typ, options}
 }
 
 type VportHandle struct {
@@ -91,7 +195,43 @@ type VportHandle struct {
 	dpIfIndex int32
 }
 
-func (dpif *Dpif) parseVport(msg *NlMsgParser) (h VportHandle, s VportSpec, err error) {
+// Reconstruct a handle for the vport with the given port number on
+// this datapath.  As with Dpif.NewDatapathHandle, the vport is not
+// checked to exist.
+func (dp DatapathHandle) NewVportHandle(portNo uint32) VportHandle {
+	return VportHandle{dpif: dp.dpif, portNo: portNo, dpIfIndex: dp.ifindex}
+}
+
+func (h VportHandle) PortNo() uint32 {
+	return h.portNo
+}
+
+// The datapath the vport belongs to.  The returned handle does not
+// know the datapath's name; see DatapathHandle.LookupName.
+func (h VportHandle) Datapath() DatapathHandle {
+	return DatapathHandle{dpif: h.dpif, ifindex: h.dpIfIndex}
+}
+
+type Vport struct {
+	Handle VportHandle
+	Spec   VportSpec
+
+	// Netlink pids that upcalls from this vport are sent to
+	UpcallPids []uint32
+
+	// Interface index of the vport's network device, if the
+	// kernel reports it
+	IfIndex uint32
+
+	// If the vport's network device is in a different network
+	// namespace to the Dpif's socket, the id of that namespace
+	// relative to the socket's namespace
+	NetnsId        int32
+	NetnsIdPresent bool
+}
+
+func (dpif *Dpif) parseVport(msg *NlMsgParser) (vport Vport, err error) {
+	h := &vport.Handle
 	h.dpif = dpif
 
 	_, err = msg.ExpectNlMsghdr(dpif.familyIds[VPORT])
@@ -130,6 +270,28 @@ func (dpif *Dpif) parseVport(msg *NlMsgParser) (h VportHandle, s VportSpec, err
 		return
 	}
 
+	vport.UpcallPids, err = attrs.GetUint32Array(OVS_VPORT_ATTR_UPCALL_PID, true)
+	if err != nil {
+		return
+	}
+
+	vport.IfIndex, _, err = attrs.GetOptionalUint32(OVS_VPORT_ATTR_IFINDEX)
+	if err != nil {
+		return
+	}
+
+	netnsId, present, err := attrs.GetOptionalUint32(OVS_VPORT_ATTR_NETNSID)
+	if err != nil {
+		return
+	}
+	vport.NetnsId = int32(netnsId)
+	vport.NetnsIdPresent = present
+
+	rawOpts, err := attrs.Get(OVS_VPORT_ATTR_OPTIONS, true)
+	if err != nil {
+		return
+	}
+
 	opts, err := attrs.GetNestedAttrs(OVS_VPORT_ATTR_OPTIONS, true)
 	if err != nil {
 		return
@@ -140,27 +302,60 @@ func (dpif *Dpif) parseVport(msg *NlMsgParser) (h VportHandle, s VportSpec, err
 
 	switch typ {
 	case OVS_VPORT_TYPE_NETDEV:
-		s = NewNetdevVportSpec(name)
+		vport.Spec = NewNetdevVportSpec(name)
 		break
 
 	case OVS_VPORT_TYPE_INTERNAL:
-		s = NewInternalVportSpec(name)
+		vport.Spec = NewInternalVportSpec(name)
+		break
+
+	case OVS_VPORT_TYPE_GRE:
+		vport.Spec = NewGreVportSpec(name)
 		break
 
 	case OVS_VPORT_TYPE_VXLAN:
-		s, err = parseVxlanVportSpec(name, opts)
+		vport.Spec, err = parseVxlanVportSpec(name, opts)
+		break
+
+	case OVS_VPORT_TYPE_GENEVE:
+		vport.Spec, err = parseGeneveVportSpec(name, opts)
 		break
 
 	default:
-		err = fmt.Errorf("unsupported vport type %d", typ)
+		vport.Spec = NewGenericVportSpec(name, typ, append([]byte{}, rawOpts...))
 	}
 
 	return
 }
 
+type VportOptions struct {
+	// Netlink pids to send upcalls from the vport to.  The
+	// kernel spreads upcalls across them according to a hash of
+	// the packet.  If empty, upcalls go to the Dpif's socket.
+	UpcallPids []uint32
+
+	// Port number to give the vport.  If zero, the kernel picks
+	// the lowest free port number.  (Port number zero always
+	// belongs to the datapath's local vport.)
+	PortNo uint32
+}
+
 func (dp DatapathHandle) CreateVport(spec VportSpec) (VportHandle, error) {
+	return dp.CreateVportWithOptions(spec, VportOptions{})
+}
+
+func (dp DatapathHandle) CreateVportWithOptions(spec VportSpec, opts VportOptions) (VportHandle, error) {
+	return dp.CreateVportContext(context.Background(), spec, opts)
+}
+
+func (dp DatapathHandle) CreateVportContext(ctx context.Context, spec VportSpec, opts VportOptions) (VportHandle, error) {
 	dpif := dp.dpif
 
+	upcallPids := opts.UpcallPids
+	if len(upcallPids) == 0 {
+		upcallPids = []uint32{dpif.sock.Pid()}
+	}
+
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[VPORT])
 	req.PutGenlMsghdr(OVS_VPORT_CMD_NEW, OVS_VPORT_VERSION)
 	req.putOvsHeader(dp.ifindex)
@@ -169,58 +364,70 @@ func (dp DatapathHandle) CreateVport(spec VportSpec) (VportHandle, error) {
 	req.PutNestedAttrs(OVS_VPORT_ATTR_OPTIONS, func() {
 		spec.optionNlAttrs(req)
 	})
-	req.PutUint32Attr(OVS_VPORT_ATTR_UPCALL_PID, dpif.sock.Pid())
+	req.PutUint32ArrayAttr(OVS_VPORT_ATTR_UPCALL_PID, upcallPids)
+
+	if opts.PortNo != 0 {
+		req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, opts.PortNo)
+	}
 
-	resp, err := dpif.sock.Request(req)
+	resp, err := dpif.request(ctx, "create vport", VPORT, dp.name, req)
 	if err != nil {
 		return VportHandle{}, err
 	}
 
-	h, _, err := dpif.parseVport(resp)
+	vport, err := dpif.parseVport(resp)
 	if err != nil {
 		return VportHandle{}, err
 	}
 
-	return h, nil
+	return vport.Handle, nil
 }
 
 func IsNoSuchVportError(err error) bool {
-	return err == NetlinkError(syscall.ENODEV)
+	return errors.Is(err, ErrNoSuchVport)
 }
 
-type Vport struct {
-	Handle VportHandle
-	Spec   VportSpec
+// Whether CreateVportWithOptions failed because the requested port
+// number is already used by another vport
+func IsPortNoInUseError(err error) bool {
+	return errors.Is(err, ErrPortNoInUse)
 }
 
-func lookupVport(dpif *Dpif, dpifindex int32, name string) (Vport, error) {
+func lookupVport(ctx context.Context, dpif *Dpif, dpifindex int32, dpname string, name string) (Vport, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[VPORT])
 	req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
 	req.putOvsHeader(dpifindex)
 	req.PutStringAttr(OVS_VPORT_ATTR_NAME, name)
 
-	resp, err := dpif.sock.Request(req)
+	resp, err := dpif.request(ctx, "look up vport", VPORT, dpname, req)
 	if err != nil {
 		return Vport{}, err
 	}
 
-	h, s, err := dpif.parseVport(resp)
-	if err != nil {
-		return Vport{}, err
-	}
-
-	return Vport{h, s}, nil
+	return dpif.parseVport(resp)
 }
 
 func (dpif *Dpif) LookupVport(name string) (Vport, error) {
-	return lookupVport(dpif, 0, name)
+	return dpif.LookupVportContext(context.Background(), name)
+}
+
+func (dpif *Dpif) LookupVportContext(ctx context.Context, name string) (Vport, error) {
+	return lookupVport(ctx, dpif, 0, "", name)
 }
 
 func (dp DatapathHandle) LookupVport(name string) (Vport, error) {
-	return lookupVport(dp.dpif, dp.ifindex, name)
+	return dp.LookupVportContext(context.Background(), name)
+}
+
+func (dp DatapathHandle) LookupVportContext(ctx context.Context, name string) (Vport, error) {
+	return lookupVport(ctx, dp.dpif, dp.ifindex, dp.name, name)
 }
 
 func (h VportHandle) Lookup() (Vport, error) {
+	return h.LookupContext(context.Background())
+}
+
+func (h VportHandle) LookupContext(ctx context.Context) (Vport, error) {
 	dpif := h.dpif
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[VPORT])
@@ -228,21 +435,20 @@ func (h VportHandle) Lookup() (Vport, error) {
 	req.putOvsHeader(h.dpIfIndex)
 	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, h.portNo)
 
-	resp, err := dpif.sock.Request(req)
+	resp, err := dpif.request(ctx, "look up vport", VPORT, "", req)
 	if err != nil {
 		return Vport{}, err
 	}
 
-	h, s, err := dpif.parseVport(resp)
-	if err != nil {
-		return Vport{}, err
-	}
-
-	return Vport{h, s}, nil
+	return dpif.parseVport(resp)
 }
 
 func (h VportHandle) LookupName() (string, error) {
-	vport, err := h.Lookup()
+	return h.LookupNameContext(context.Background())
+}
+
+func (h VportHandle) LookupNameContext(ctx context.Context) (string, error) {
+	vport, err := h.LookupContext(ctx)
 	if err != nil {
 		if !IsNoSuchVportError(err) {
 			return "", err
@@ -257,31 +463,92 @@ func (h VportHandle) LookupName() (string, error) {
 }
 
 func (dp DatapathHandle) EnumerateVports() ([]Vport, error) {
+	return dp.EnumerateVportsContext(context.Background())
+}
+
+func (dp DatapathHandle) EnumerateVportsContext(ctx context.Context) ([]Vport, error) {
 	dpif := dp.dpif
-	res := make([]Vport, 0)
+	var res []Vport
 
-	req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[VPORT])
-	req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	newReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(DumpFlags, dpif.familyIds[VPORT])
+		req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
+		req.putOvsHeader(dp.ifindex)
+		return req
+	}
+
+	reset := func() { res = make([]Vport, 0) }
 
 	consumer := func(resp *NlMsgParser) error {
-		h, spec, err := dpif.parseVport(resp)
+		vport, err := dpif.parseVport(resp)
 		if err != nil {
 			return err
 		}
-		res = append(res, Vport{h, spec})
+		res = append(res, vport)
 		return nil
 	}
 
-	err := dpif.sock.RequestMulti(req, consumer)
+	err := dpif.dump(ctx, "enumerate vports", VPORT, dp.name, newReq, reset, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Enumerate the vports of every datapath, keyed by datapath name.
+// The kernel can only dump the vports of one datapath at a time, so
+// this is not atomic: a datapath deleted part way through is omitted.
+func (dpif *Dpif) EnumerateAllVports() (map[string][]Vport, error) {
+	return dpif.EnumerateAllVportsContext(context.Background())
+}
+
+func (dpif *Dpif) EnumerateAllVportsContext(ctx context.Context) (map[string][]Vport, error) {
+	dps, err := dpif.EnumerateDatapathsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	res := make(map[string][]Vport)
+	for name, dp := range dps {
+		vports, err := dp.EnumerateVportsContext(ctx)
+		if err != nil {
+			if IsNoSuchDatapathError(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		res[name] = vports
+	}
+
 	return res, nil
 }
 
+// Change the netlink pids that upcalls from the vport are sent to
+func (vport VportHandle) SetUpcallPids(pids []uint32) error {
+	return vport.SetUpcallPidsContext(context.Background(), pids)
+}
+
+func (vport VportHandle) SetUpcallPidsContext(ctx context.Context, pids []uint32) error {
+	dpif := vport.dpif
+
+	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[VPORT])
+	req.PutGenlMsghdr(OVS_VPORT_CMD_SET, OVS_VPORT_VERSION)
+	req.putOvsHeader(vport.dpIfIndex)
+	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, vport.portNo)
+	req.PutUint32ArrayAttr(OVS_VPORT_ATTR_UPCALL_PID, pids)
+
+	_, err := dpif.request(ctx, "set vport upcall pids", VPORT, "", req)
+	return err
+}
+
 func (vport VportHandle) Delete() error {
+	return vport.DeleteContext(context.Background())
+}
+
+func (vport VportHandle) DeleteContext(ctx context.Context) error {
 	dpif := vport.dpif
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.familyIds[VPORT])
@@ -289,7 +556,7 @@ func (vport VportHandle) Delete() error {
 	req.putOvsHeader(vport.dpIfIndex)
 	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, vport.portNo)
 
-	_, err := dpif.sock.Request(req)
+	_, err := dpif.request(ctx, "delete vport", VPORT, "", req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,69 @@
+package odp
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Encode a vport spec's options and parse them back, without
+// involving the kernel
+func roundTripVportOptions(spec VportSpec, t *testing.T) Attrs {
+	msg := NewNlMsgBuilder(0, 0)
+	msg.PutNestedAttrs(OVS_VPORT_ATTR_OPTIONS, func() {
+		spec.optionNlAttrs(msg)
+	})
+	data, _ := msg.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := attrs.GetNestedAttrs(OVS_VPORT_ATTR_OPTIONS, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func TestVxlanVportSpecOptions(t *testing.T) {
+	for _, spec := range []VportSpec{
+		NewVxlanVportSpec("vx", 4789),
+		NewVxlanGbpVportSpec("vx", 4790),
+	} {
+		got, err := parseVxlanVportSpec("vx", roundTripVportOptions(spec, t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != spec {
+			t.Fatalf("expected %v, got %v", spec, got)
+		}
+	}
+}
+
+func TestGenericVportSpecOptions(t *testing.T) {
+	// Encode some options as an unknown vport type would have them
+	msg := NewNlMsgBuilder(0, 0)
+	msg.PutUint16Attr(OVS_TUNNEL_ATTR_DST_PORT, 4341)
+	msg.PutUint32Attr(100, 42)
+	data, _ := msg.Finish()
+	rawOpts := data[syscall.NLMSG_HDRLEN:]
+
+	spec := NewGenericVportSpec("lisp0", 100, rawOpts)
+	if spec.TypeName() != "type-100" {
+		t.Fatal(spec.TypeName())
+	}
+
+	opts := roundTripVportOptions(spec, t)
+	port, err := opts.GetUint16(OVS_TUNNEL_ATTR_DST_PORT)
+	if err != nil || port != 4341 {
+		t.Fatal(port, err)
+	}
+
+	val, err := opts.GetUint32(100)
+	if err != nil || val != 42 {
+		t.Fatal(val, err)
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/dpw/go-odp/odp"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action expressions, as accepted by the --action option and printed
+// by "flow list".  An expression is a comma-separated list of
+// actions, each of which is a name optionally followed by a
+// parenthesised, comma-separated list of arguments:
+//
+//	ct(commit,zone=1,mark=0x1/0xff,nat(src,ip=10.0.0.1-10.0.0.9,port=1024-2047))
+//	check_pkt_len(size=1500,gt(trunc(1500),output(vp1)),le(output(vp1)))
+//
+// Actions that take a list of actions (clone and the branches of
+// check_pkt_len) accept output(VPORT), meter(ID) and raw(TYPE:HEX)
+// within it, corresponding to --output, --meter and --raw-action.
+
+type actionParser struct {
+	dpif *odp.Dpif
+	s    string
+	pos  int
+}
+
+func parseActions(s string, dpif *odp.Dpif) ([]odp.Action, error) {
+	p := actionParser{dpif: dpif, s: s}
+	actions, err := p.actionList()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.s) {
+		return nil, p.errorf("unexpected \"%c\"", p.s[p.pos])
+	}
+
+	return actions, nil
+}
+
+func (p *actionParser) errorf(f string, a ...interface{}) error {
+	return fmt.Errorf("invalid action \"%s\" at position %d: %s",
+		p.s, p.pos, fmt.Sprintf(f, a...))
+}
+
+func (p *actionParser) accept(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *actionParser) expect(c byte) error {
+	if !p.accept(c) {
+		return p.errorf("expected \"%c\"", c)
+	}
+
+	return nil
+}
+
+// Scan a name: lower case letters, digits and underscores
+func (p *actionParser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			break
+		}
+		p.pos++
+	}
+
+	return p.s[start:p.pos]
+}
+
+// Scan the value of a name=value argument, which extends up to the
+// next comma or parenthesis.
+func (p *actionParser) value(arg string) (string, error) {
+	if err := p.expect('='); err != nil {
+		return "", err
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(",()", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", p.errorf("missing value for \"%s\"", arg)
+	}
+
+	return p.s[start:p.pos], nil
+}
+
+// Parse an optional parenthesised argument list, calling f with the
+// name of each argument.  f consumes anything following the name.
+func (p *actionParser) args(f func(arg string) error) error {
+	if !p.accept('(') || p.accept(')') {
+		return nil
+	}
+
+	for {
+		arg := p.name()
+		if arg == "" {
+			return p.errorf("expected argument name")
+		}
+
+		if err := f(arg); err != nil {
+			return err
+		}
+
+		if p.accept(')') {
+			return nil
+		}
+
+		if err := p.expect(','); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *actionParser) actionList() ([]odp.Action, error) {
+	var actions []odp.Action
+
+	for {
+		action, err := p.action()
+		if err != nil {
+			return nil, err
+		}
+
+		actions = append(actions, action)
+		if !p.accept(',') {
+			return actions, nil
+		}
+	}
+}
+
+// Parse a parenthesised, possibly empty, list of actions
+func (p *actionParser) nestedActions() ([]odp.Action, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	if p.accept(')') {
+		return nil, nil
+	}
+
+	actions, err := p.actionList()
+	if err != nil {
+		return nil, err
+	}
+
+	return actions, p.expect(')')
+}
+
+// Scan a single parenthesised argument
+func (p *actionParser) singleArg(action string) (string, error) {
+	if err := p.expect('('); err != nil {
+		return "", err
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(",()", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", p.errorf("missing argument for \"%s\"", action)
+	}
+
+	arg := p.s[start:p.pos]
+	return arg, p.expect(')')
+}
+
+func (p *actionParser) action() (odp.Action, error) {
+	name := p.name()
+	switch name {
+	case "ct":
+		return p.conntrack()
+
+	case "trunc":
+		arg, err := p.singleArg(name)
+		if err != nil {
+			return nil, err
+		}
+
+		maxLen, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return nil, p.errorf("invalid length \"%s\"", arg)
+		}
+
+		return odp.TruncateAction(maxLen), nil
+
+	case "clone":
+		actions, err := p.nestedActions()
+		if err != nil {
+			return nil, err
+		}
+
+		return odp.CloneAction{Actions: actions}, nil
+
+	case "check_pkt_len":
+		return p.checkPktLen()
+
+	case "output":
+		arg, err := p.singleArg(name)
+		if err != nil {
+			return nil, err
+		}
+
+		vport, err := p.dpif.LookupVport(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		return odp.NewOutputAction(vport.Handle), nil
+
+	case "meter":
+		arg, err := p.singleArg(name)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return nil, p.errorf("invalid meter id \"%s\"", arg)
+		}
+
+		return odp.MeterAction(id), nil
+
+	case "raw":
+		arg, err := p.singleArg(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseRawAction(arg)
+
+	case "":
+		return nil, p.errorf("expected action name")
+
+	default:
+		return nil, p.errorf("unknown action \"%s\"", name)
+	}
+}
+
+func (p *actionParser) conntrack() (odp.Action, error) {
+	var ct odp.ConntrackAction
+
+	err := p.args(func(arg string) error {
+		switch arg {
+		case "commit":
+			ct.Commit = true
+
+		case "force_commit":
+			ct.ForceCommit = true
+
+		case "zone":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			zone, err := strconv.ParseUint(v, 0, 16)
+			if err != nil {
+				return p.errorf("invalid zone \"%s\"", v)
+			}
+
+			ct.Zone = uint16(zone)
+			ct.ZonePresent = true
+
+		case "mark":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			ct.Mark, ct.MarkMask, err = parseMaskedUint32(v)
+			if err != nil {
+				return p.errorf("invalid mark \"%s\"", v)
+			}
+
+			ct.MarkPresent = true
+
+		case "labels":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			err = parseMaskedBytes(v, ct.Labels[:], ct.LabelsMask[:])
+			if err != nil {
+				return p.errorf("invalid labels \"%s\"", v)
+			}
+
+			ct.LabelsPresent = true
+
+		case "helper":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			ct.Helper = v
+
+		case "timeout":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			ct.Timeout = v
+
+		case "eventmask":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			mask, err := strconv.ParseUint(v, 0, 32)
+			if err != nil {
+				return p.errorf("invalid eventmask \"%s\"", v)
+			}
+
+			ct.EventMask = uint32(mask)
+			ct.EventMaskPresent = true
+
+		case "nat":
+			nat, err := p.conntrackNat()
+			if err != nil {
+				return err
+			}
+
+			ct.Nat = nat
+
+		default:
+			return p.errorf("unknown ct argument \"%s\"", arg)
+		}
+
+		return nil
+	})
+
+	return ct, err
+}
+
+func (p *actionParser) checkPktLen() (odp.Action, error) {
+	var cpl odp.CheckPktLenAction
+	sizePresent := false
+
+	err := p.args(func(arg string) error {
+		var err error
+
+		switch arg {
+		case "size":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			size, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return p.errorf("invalid size \"%s\"", v)
+			}
+
+			cpl.PktLen = uint16(size)
+			sizePresent = true
+
+		case "gt":
+			cpl.IfGreater, err = p.nestedActions()
+
+		case "le":
+			cpl.IfLessEqual, err = p.nestedActions()
+
+		default:
+			err = p.errorf("unknown check_pkt_len argument \"%s\"", arg)
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !sizePresent {
+		return nil, p.errorf("check_pkt_len requires a size")
+	}
+
+	return cpl, nil
+}
+
+func (p *actionParser) conntrackNat() (*odp.ConntrackNat, error) {
+	var nat odp.ConntrackNat
+
+	err := p.args(func(arg string) error {
+		switch arg {
+		case "src":
+			nat.Src = true
+
+		case "dst":
+			nat.Dst = true
+
+		case "persistent":
+			nat.Persistent = true
+
+		case "hash":
+			nat.ProtoHash = true
+
+		case "random":
+			nat.ProtoRandom = true
+
+		case "ip":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			min, max, ranged := strings.Cut(v, "-")
+			nat.IpMin = parseNatIp(min)
+			if nat.IpMin == nil {
+				return p.errorf("invalid address \"%s\"", min)
+			}
+
+			if ranged {
+				nat.IpMax = parseNatIp(max)
+				if nat.IpMax == nil || len(nat.IpMax) != len(nat.IpMin) {
+					return p.errorf("invalid address \"%s\"", max)
+				}
+			}
+
+		case "port":
+			v, err := p.value(arg)
+			if err != nil {
+				return err
+			}
+
+			min, max, ranged := strings.Cut(v, "-")
+			port, err := strconv.ParseUint(min, 10, 16)
+			if err != nil {
+				return p.errorf("invalid port \"%s\"", min)
+			}
+
+			nat.ProtoMin = uint16(port)
+			nat.ProtoMinPresent = true
+
+			if ranged {
+				port, err = strconv.ParseUint(max, 10, 16)
+				if err != nil {
+					return p.errorf("invalid port \"%s\"", max)
+				}
+
+				nat.ProtoMax = uint16(port)
+				nat.ProtoMaxPresent = true
+			}
+
+		default:
+			return p.errorf("unknown nat argument \"%s\"", arg)
+		}
+
+		return nil
+	})
+
+	return &nat, err
+}
+
+// Parse a value with an optional mask, as V/M.  If the mask is
+// omitted, all bits are set.
+func parseMaskedUint32(s string) (uint32, uint32, error) {
+	v, m, masked := strings.Cut(s, "/")
+	val, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mask := uint64(0xffffffff)
+	if masked {
+		mask, err = strconv.ParseUint(m, 0, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return uint32(val), uint32(mask), nil
+}
+
+// Parse a hex byte string with an optional mask, as V/M, into val and
+// mask.  Both must fill their destinations exactly.
+func parseMaskedBytes(s string, val []byte, mask []byte) error {
+	v, m, masked := strings.Cut(s, "/")
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != len(val) {
+		return fmt.Errorf("expected %d bytes", len(val))
+	}
+	copy(val, b)
+
+	if !masked {
+		for i := range mask {
+			mask[i] = 0xff
+		}
+		return nil
+	}
+
+	b, err = hex.DecodeString(m)
+	if err != nil || len(b) != len(mask) {
+		return fmt.Errorf("expected %d bytes", len(mask))
+	}
+	copy(mask, b)
+	return nil
+}
+
+// Parse an IPv4 or IPv6 address into the 4 or 16 bytes of a NAT range
+func parseNatIp(s string) []byte {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(s, ":") {
+		return ip4
+	}
+
+	return ip.To16()
+}
+
+// Format an action as an expression.  Actions without an expression
+// syntax are formatted with %v, which parseActions does not accept.
+func formatAction(a odp.Action, dp odp.DatapathHandle) (string, error) {
+	switch a := a.(type) {
+	case odp.ConntrackAction:
+		return formatConntrackAction(a), nil
+
+	case odp.TruncateAction:
+		return fmt.Sprintf("trunc(%d)", uint32(a)), nil
+
+	case odp.CloneAction:
+		actions, err := formatActions(a.Actions, dp)
+		return "clone(" + actions + ")", err
+
+	case odp.CheckPktLenAction:
+		gt, err := formatActions(a.IfGreater, dp)
+		if err != nil {
+			return "", err
+		}
+
+		le, err := formatActions(a.IfLessEqual, dp)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("check_pkt_len(size=%d,gt(%s),le(%s))",
+			a.PktLen, gt, le), nil
+
+	case odp.OutputAction:
+		name, err := a.VportHandle(dp).LookupName()
+		return "output(" + name + ")", err
+
+	case odp.MeterAction:
+		return fmt.Sprintf("meter(%d)", uint32(a)), nil
+
+	case odp.RawAction:
+		return fmt.Sprintf("raw(%d:%s)", a.Type, hex.EncodeToString(a.Data)), nil
+
+	default:
+		return fmt.Sprintf("%v", a), nil
+	}
+}
+
+func formatActions(actions []odp.Action, dp odp.DatapathHandle) (string, error) {
+	res := make([]string, len(actions))
+	for i, a := range actions {
+		var err error
+		res[i], err = formatAction(a, dp)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(res, ","), nil
+}
+
+func formatConntrackAction(ct odp.ConntrackAction) string {
+	var args []string
+
+	if ct.Commit {
+		args = append(args, "commit")
+	}
+
+	if ct.ForceCommit {
+		args = append(args, "force_commit")
+	}
+
+	if ct.ZonePresent {
+		args = append(args, fmt.Sprintf("zone=%d", ct.Zone))
+	}
+
+	if ct.MarkPresent {
+		args = append(args, fmt.Sprintf("mark=0x%x/0x%x", ct.Mark, ct.MarkMask))
+	}
+
+	if ct.LabelsPresent {
+		args = append(args, fmt.Sprintf("labels=%s/%s",
+			hex.EncodeToString(ct.Labels[:]),
+			hex.EncodeToString(ct.LabelsMask[:])))
+	}
+
+	if ct.Helper != "" {
+		args = append(args, "helper="+ct.Helper)
+	}
+
+	if ct.Timeout != "" {
+		args = append(args, "timeout="+ct.Timeout)
+	}
+
+	if ct.EventMaskPresent {
+		args = append(args, fmt.Sprintf("eventmask=0x%x", ct.EventMask))
+	}
+
+	if ct.Nat != nil {
+		args = append(args, "nat"+formatArgs(formatConntrackNat(*ct.Nat)))
+	}
+
+	return "ct" + formatArgs(args)
+}
+
+func formatConntrackNat(nat odp.ConntrackNat) []string {
+	var args []string
+
+	if nat.Src {
+		args = append(args, "src")
+	}
+
+	if nat.Dst {
+		args = append(args, "dst")
+	}
+
+	if nat.IpMin != nil {
+		ip := "ip=" + net.IP(nat.IpMin).String()
+		if nat.IpMax != nil {
+			ip += "-" + net.IP(nat.IpMax).String()
+		}
+		args = append(args, ip)
+	}
+
+	if nat.ProtoMinPresent {
+		port := fmt.Sprintf("port=%d", nat.ProtoMin)
+		if nat.ProtoMaxPresent {
+			port += fmt.Sprintf("-%d", nat.ProtoMax)
+		}
+		args = append(args, port)
+	}
+
+	if nat.Persistent {
+		args = append(args, "persistent")
+	}
+
+	if nat.ProtoHash {
+		args = append(args, "hash")
+	}
+
+	if nat.ProtoRandom {
+		args = append(args, "random")
+	}
+
+	return args
+}
+
+func formatArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	return "(" + strings.Join(args, ",") + ")"
+}
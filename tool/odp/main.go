@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/dpw/go-odp/odp"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 func printErr(f string, a ...interface{}) bool {
@@ -16,6 +21,53 @@ func printErr(f string, a ...interface{}) bool {
 	return false
 }
 
+func inDatapath(operr *odp.OpError) string {
+	if operr.Datapath == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" in datapath \"%s\"", operr.Datapath)
+}
+
+// Print a human-oriented message for an error, particularly one
+// returned from the odp package
+func printOpErr(err error) bool {
+	var operr *odp.OpError
+	if !errors.As(err, &operr) {
+		return printErr("%s", err)
+	}
+
+	switch {
+	case errors.Is(err, odp.ErrModuleNotLoaded):
+		return printErr("The Open vSwitch kernel module is not loaded.  Try \"modprobe openvswitch\"")
+	case errors.Is(err, odp.ErrNotSupported):
+		return printErr("The Open vSwitch kernel module does not support %s; it may be too old", operr.Family)
+	case errors.Is(err, syscall.EPERM):
+		return printErr("Permission denied (%s).  Controlling the datapath requires CAP_NET_ADMIN", operr.Op)
+	case errors.Is(err, odp.ErrNoSuchVportOrDatapath):
+		return printErr("Cannot find port or datapath%s", inDatapath(operr))
+	case errors.Is(err, odp.ErrNoSuchDatapath):
+		if operr.Datapath != "" {
+			return printErr("Cannot find datapath \"%s\"", operr.Datapath)
+		}
+		return printErr("Cannot find datapath")
+	case errors.Is(err, odp.ErrDatapathExists):
+		return printErr("Datapath \"%s\" already exists", operr.Datapath)
+	case errors.Is(err, odp.ErrNoSuchVport):
+		return printErr("Cannot find port%s", inDatapath(operr))
+	case errors.Is(err, odp.ErrVportExists):
+		return printErr("A port with that name already exists%s", inDatapath(operr))
+	case errors.Is(err, odp.ErrNoSuchFlow):
+		return printErr("Cannot find flow%s", inDatapath(operr))
+	case errors.Is(err, odp.ErrFlowExists):
+		return printErr("Flow already exists%s", inDatapath(operr))
+	case errors.Is(err, odp.ErrNoSuchMeter):
+		return printErr("Cannot find meter%s", inDatapath(operr))
+	}
+
+	return printErr("%s", err)
+}
+
 type commandDispatch interface {
 	run(args []string, pos int) bool
 }
@@ -49,6 +101,16 @@ func (f Flags) Parse() bool {
 	return true
 }
 
+// Parse flags and at most one further argument, returning it (or
+// the empty string if absent)
+func (f Flags) ParseOptionalArg() (string, bool) {
+	f.FlagSet.Parse(f.args)
+	if f.NArg() > 1 {
+		return "", printErr("Excess arguments")
+	}
+	return f.Arg(0), true
+}
+
 type command struct {
 	cmd       func([]string, Flags) bool
 	fixedArgs int
@@ -81,7 +143,7 @@ var commands = subcommands{
 	"datapath": possibleSubcommands{
 		command{listDatapaths, 0},
 		subcommands{
-			"add": command{addDatapath, 1},
+			"add":    command{addDatapath, 1},
 			"delete": command{deleteDatapath, 1},
 		},
 	},
@@ -90,37 +152,152 @@ var commands = subcommands{
 			"netdev":   command{addNetdevVport, 2},
 			"internal": command{addInternalVport, 2},
 			"vxlan":    command{addVxlanVport, 2},
+			"gre":      command{addGreVport, 2},
+			"geneve":   command{addGeneveVport, 2},
 		},
 		"delete": command{deleteVport, 1},
-		"list":   command{listVports, 1},
+		"list":   command{listVports, 0},
 	},
 	"flow": subcommands{
-		"add": command{addFlow, 1},
+		"add":    command{addFlow, 1},
 		"delete": command{deleteFlow, 1},
 		"list":   command{listFlows, 1},
 	},
+	"meter": subcommands{
+		"add":    command{addMeter, 2},
+		"delete": command{deleteMeter, 2},
+		"list":   command{listMeters, 1},
+	},
+	"ct-limit": subcommands{
+		"set":    command{setCtLimits, 0},
+		"get":    command{getCtLimits, 0},
+		"delete": command{deleteCtLimits, 0},
+	},
 }
 
+var trace bool
+var record string
+
+// Set by newDpif when recording
+var recordFile *os.File
+var recorder *odp.PcapWriter
+
 func main() {
-	if !commands.run(os.Args, 1) {
+	flag.BoolVar(&trace, "trace", false, "print the netlink messages exchanged with the kernel")
+	flag.StringVar(&record, "record", "", "record the netlink messages exchanged with the kernel in a pcap `file`")
+	flag.Parse()
+
+	args := append([]string{os.Args[0]}, flag.Args()...)
+	ok := commands.run(args, 1)
+	if !finishRecording() {
+		ok = false
+	}
+
+	if !ok {
 		os.Exit(1)
 	}
 }
 
+// Close the recording, if any.  Returns false if it could not be
+// written in full.
+func finishRecording() bool {
+	if recordFile == nil {
+		return true
+	}
+
+	err := recorder.Err()
+	if cerr := recordFile.Close(); err == nil {
+		err = cerr
+	}
+
+	recordFile = nil
+	if err != nil {
+		return printErr("Error recording to %s: %s", record, err)
+	}
+
+	return true
+}
+
+func newDpif() (*odp.Dpif, error) {
+	if !trace && record == "" {
+		return odp.NewDpif()
+	}
+
+	sock, err := odp.OpenNetlinkSocket(syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+
+	var pw *odp.PcapWriter
+	if record != "" {
+		f, err := os.Create(record)
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+
+		pw, err = odp.NewPcapWriter(f, syscall.NETLINK_GENERIC)
+		if err != nil {
+			f.Close()
+			sock.Close()
+			return nil, err
+		}
+
+		// main closes the file, even if creating the Dpif
+		// fails
+		recordFile = f
+		recorder = pw
+	}
+
+	// The family names are only known once the Dpif has looked
+	// them up
+	var lock sync.Mutex
+	var families map[uint16]string
+
+	sock.SetTracer(func(sent bool, data []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if pw != nil {
+			// A failure is reported by finishRecording
+			pw.Trace(sent, data)
+		}
+
+		if trace {
+			dir := "received"
+			if sent {
+				dir = "sent"
+			}
+
+			fmt.Fprintf(os.Stderr, "%s:\n%s", dir, odp.DecodeNetlinkMessages(data, families))
+		}
+	})
+
+	dpif, err := odp.NewDpifWithSocket(context.Background(), sock)
+	if err != nil {
+		return nil, err
+	}
+
+	lock.Lock()
+	families = dpif.FamilyNames()
+	lock.Unlock()
+	return dpif, nil
+}
+
 func addDatapath(args []string, f Flags) bool {
 	if !f.Parse() {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
 	_, err = dpif.CreateDatapath(args[0])
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	return true
@@ -131,24 +308,20 @@ func deleteDatapath(args []string, f Flags) bool {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
 	dp, err := dpif.LookupDatapath(args[0])
 	if err != nil {
-		return printErr("%s", err)
-	}
-
-	if odp.IsNoSuchDatapathError(err) {
-		return printErr("Cannot find datapath \"%s\"", args[0])
+		return printOpErr(err)
 	}
 
 	err = dp.Delete()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	return true
@@ -159,9 +332,9 @@ func listDatapaths(_ []string, f Flags) bool {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
@@ -174,23 +347,28 @@ func listDatapaths(_ []string, f Flags) bool {
 }
 
 func addNetdevVport(args []string, f Flags) bool {
+	portNo := portNoFlag(f)
 	if !f.Parse() {
 		return false
 	}
-	return addVport(args[0], odp.NewNetdevVportSpec(args[1]))
+	return addVport(args[0], odp.NewNetdevVportSpec(args[1]), *portNo)
 }
 
 func addInternalVport(args []string, f Flags) bool {
+	portNo := portNoFlag(f)
 	if !f.Parse() {
 		return false
 	}
-	return addVport(args[0], odp.NewInternalVportSpec(args[1]))
+	return addVport(args[0], odp.NewInternalVportSpec(args[1]), *portNo)
 }
 
 func addVxlanVport(args []string, f Flags) bool {
 	var destPort uint
+	var gbp bool
+	portNo := portNoFlag(f)
 	// 4789 is the IANA assigned port number for VXLAN
 	f.UintVar(&destPort, "destport", 4789, "destination UDP port number")
+	f.BoolVar(&gbp, "gbp", false, "enable the Group Based Policy extension")
 	if !f.Parse() {
 		return false
 	}
@@ -199,24 +377,64 @@ func addVxlanVport(args []string, f Flags) bool {
 		return printErr("destport too large")
 	}
 
-	return addVport(args[0], odp.NewVxlanVportSpec(args[1], uint16(destPort)))
+	if gbp {
+		return addVport(args[0], odp.NewVxlanGbpVportSpec(args[1], uint16(destPort)), *portNo)
+	}
+
+	return addVport(args[0], odp.NewVxlanVportSpec(args[1], uint16(destPort)), *portNo)
 }
 
-func addVport(dpname string, spec odp.VportSpec) bool {
-	dpif, err := odp.NewDpif()
+func addGeneveVport(args []string, f Flags) bool {
+	var destPort uint
+	portNo := portNoFlag(f)
+	// 6081 is the IANA assigned port number for Geneve
+	f.UintVar(&destPort, "destport", 6081, "destination UDP port number")
+	if !f.Parse() {
+		return false
+	}
+
+	if destPort > 65535 {
+		return printErr("destport too large")
+	}
+
+	return addVport(args[0], odp.NewGeneveVportSpec(args[1], uint16(destPort)), *portNo)
+}
+
+func addGreVport(args []string, f Flags) bool {
+	portNo := portNoFlag(f)
+	if !f.Parse() {
+		return false
+	}
+	return addVport(args[0], odp.NewGreVportSpec(args[1]), *portNo)
+}
+
+func portNoFlag(f Flags) *uint {
+	return f.Uint("port-no", 0, "port number (default: chosen by the kernel)")
+}
+
+func addVport(dpname string, spec odp.VportSpec, portNo uint) bool {
+	if portNo > 0xffffffff {
+		return printErr("port-no too large")
+	}
+
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
 	dp, err := dpif.LookupDatapath(dpname)
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
-	_, err = dp.CreateVport(spec)
+	_, err = dp.CreateVportWithOptions(spec, odp.VportOptions{PortNo: uint32(portNo)})
 	if err != nil {
-		return printErr("%s", err)
+		if odp.IsPortNoInUseError(err) {
+			return printErr("Port number %d is already in use", portNo)
+		}
+
+		return printOpErr(err)
 	}
 
 	return true
@@ -227,9 +445,9 @@ func deleteVport(args []string, f Flags) bool {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
@@ -239,48 +457,91 @@ func deleteVport(args []string, f Flags) bool {
 			return printErr("Cannot find port \"%s\"", args[0])
 		}
 
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	err = vport.Handle.Delete()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	return true
 }
 
-func listVports(args []string, f Flags) bool {
-	if !f.Parse() {
+func listVports(_ []string, f Flags) bool {
+	dpname, ok := f.ParseOptionalArg()
+	if !ok {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
-	dp, err := dpif.LookupDatapath(args[0])
+	if dpname != "" {
+		dp, err := dpif.LookupDatapath(dpname)
+		if err != nil {
+			return printOpErr(err)
+		}
+
+		vports, err := dp.EnumerateVports()
+		if err != nil {
+			return printOpErr(err)
+		}
+
+		for _, vport := range vports {
+			printVport(vport, "")
+		}
+
+		return true
+	}
+
+	// No datapath given, so list the vports of all datapaths,
+	// showing which each belongs to
+	dpvports, err := dpif.EnumerateAllVports()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
-	vports, err := dp.EnumerateVports()
-	for _, vport := range vports {
-		spec := vport.Spec
-		fmt.Printf("%s %s", spec.TypeName(), spec.Name())
+	for dpname, vports := range dpvports {
+		for _, vport := range vports {
+			printVport(vport, dpname)
+		}
+	}
 
-		switch spec := spec.(type) {
-		case odp.VxlanVportSpec:
-			fmt.Printf(" --destport=%d", spec.DestPort)
-			break
+	return true
+}
+
+func printVport(vport odp.Vport, dpname string) {
+	spec := vport.Spec
+	fmt.Printf("%s ", spec.TypeName())
+	if dpname != "" {
+		fmt.Printf("%s ", dpname)
+	}
+	fmt.Printf("%s --port-no=%d", spec.Name(), vport.Handle.PortNo())
+
+	switch spec := spec.(type) {
+	case odp.VxlanVportSpec:
+		fmt.Printf(" --destport=%d", spec.DestPort)
+		if spec.Gbp {
+			fmt.Printf(" --gbp")
 		}
+		break
 
-		fmt.Printf("\n")
+	case odp.GeneveVportSpec:
+		fmt.Printf(" --destport=%d", spec.DestPort)
+		break
+
+	case odp.GenericVportSpec:
+		if len(spec.Options) > 0 {
+			fmt.Printf(" --options=%s", hex.EncodeToString(spec.Options))
+		}
+		break
 	}
 
-	return true
+	fmt.Printf("\n")
 }
 
 func parseMAC(s string) (mac [6]byte, err error) {
@@ -351,6 +612,16 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 	f.BoolVar(&setTunDf, "set-tunnel-df", false, "action: set tunnel DF")
 	f.BoolVar(&setTunCsum, "set-tunnel-csum", false, "action: set tunnel checksum")
 
+	var meter int64
+	f.Int64Var(&meter, "meter", -1, "action: apply meter")
+
+	var rawKeys, rawActions stringList
+	f.Var(&rawKeys, "raw-key", "key: raw flow key, as type:key&mask in hex (may be repeated)")
+	f.Var(&rawActions, "raw-action", "action: raw action, as type:data in hex (may be repeated)")
+
+	var actionExprs stringList
+	f.Var(&actionExprs, "action", "action: actions such as ct(commit,zone=1) or trunc(100) (may be repeated)")
+
 	var output string
 	f.StringVar(&output, "output", "", "action: output to vports")
 
@@ -361,7 +632,7 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 	if inPort != "" {
 		vport, err := dpif.LookupVport(inPort)
 		if err != nil {
-			return flow, printErr("%s", err)
+			return flow, printOpErr(err)
 		}
 		flow.AddKey(odp.NewInPortFlowKey(vport.Handle))
 	}
@@ -369,11 +640,28 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 	// The ethernet flow key is mandatory
 	err := handleEthernetFlowKeyOptions(flow, ethSrc, ethDst)
 	if err != nil {
-		return flow, printErr("%s", err)
+		return flow, printOpErr(err)
+	}
+
+	for _, opt := range rawKeys {
+		key, err := parseRawFlowKey(opt)
+		if err != nil {
+			return flow, printOpErr(err)
+		}
+		flow.AddKey(key)
 	}
 
 	// Actions are ordered, but flags aren't.  As a temporary
-	// hack, we already put SET actions before an OUTPUT action.
+	// hack, we already put METER and SET actions before an OUTPUT
+	// action.
+
+	if meter >= 0 {
+		if meter > 0xffffffff {
+			return flow, printErr("meter id too large")
+		}
+
+		flow.AddAction(odp.MeterAction(meter))
+	}
 
 	if setTunIpv4Src != "" || setTunIpv4Dst != "" {
 		var ta odp.TunnelAttrs
@@ -382,7 +670,7 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 		if setTunId != "" {
 			ta.TunnelId, err = parseTunnelId(setTunId)
 			if err != nil {
-				return flow, printErr("%s", err)
+				return flow, printOpErr(err)
 			}
 			ta.TunnelIdPresent = true
 		}
@@ -390,7 +678,7 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 		if setTunIpv4Src != "" {
 			ta.Ipv4Src, err = parseIpv4(setTunIpv4Src)
 			if err != nil {
-				return flow, printErr("%s", err)
+				return flow, printOpErr(err)
 			}
 			ta.Ipv4SrcPresent = true
 		}
@@ -398,7 +686,7 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 		if setTunIpv4Dst != "" {
 			ta.Ipv4Dst, err = parseIpv4(setTunIpv4Dst)
 			if err != nil {
-				return flow, printErr("%s", err)
+				return flow, printOpErr(err)
 			}
 			ta.Ipv4DstPresent = true
 		}
@@ -416,14 +704,33 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 		ta.Df = setTunDf
 		ta.Csum = setTunCsum
 
-		flow.AddAction(odp.SetTunnelAction{ta})
+		flow.AddAction(odp.SetTunnelAction{TunnelAttrs: ta})
+	}
+
+	for _, opt := range rawActions {
+		action, err := parseRawAction(opt)
+		if err != nil {
+			return flow, printOpErr(err)
+		}
+		flow.AddAction(action)
+	}
+
+	for _, expr := range actionExprs {
+		actions, err := parseActions(expr, dpif)
+		if err != nil {
+			return flow, printOpErr(err)
+		}
+
+		for _, action := range actions {
+			flow.AddAction(action)
+		}
 	}
 
 	if output != "" {
 		for _, vpname := range strings.Split(output, ",") {
 			vport, err := dpif.LookupVport(vpname)
 			if err != nil {
-				return flow, printErr("%s", err)
+				return flow, printOpErr(err)
 			}
 			flow.AddAction(odp.NewOutputAction(vport.Handle))
 		}
@@ -432,6 +739,83 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (odp.FlowSpec, bool) {
 	return flow, true
 }
 
+// A flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Split a raw key or action option into its type and the rest
+func splitRawOption(opt string) (uint16, string, error) {
+	i := strings.Index(opt, ":")
+	if i < 0 {
+		return 0, "", fmt.Errorf("invalid raw option \"%s\": expected type:data", opt)
+	}
+
+	typ, err := strconv.ParseUint(opt[:i], 10, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid type in raw option \"%s\"", opt)
+	}
+
+	return uint16(typ), opt[i+1:], nil
+}
+
+// Parse a raw flow key option, as printed by "flow list".  If the
+// mask is omitted, the key is an exact match.
+func parseRawFlowKey(opt string) (odp.RawFlowKey, error) {
+	typ, rest, err := splitRawOption(opt)
+	if err != nil {
+		return odp.RawFlowKey{}, err
+	}
+
+	k, m := rest, ""
+	i := strings.Index(rest, "&")
+	if i >= 0 {
+		k, m = rest[:i], rest[i+1:]
+	}
+
+	key, err := hex.DecodeString(k)
+	if err != nil {
+		return odp.RawFlowKey{}, fmt.Errorf("invalid key in raw flow key \"%s\"", opt)
+	}
+
+	var mask []byte
+	if i >= 0 {
+		mask, err = hex.DecodeString(m)
+		if err != nil || len(mask) != len(key) {
+			return odp.RawFlowKey{}, fmt.Errorf("invalid mask in raw flow key \"%s\"", opt)
+		}
+	} else {
+		mask = make([]byte, len(key))
+		for i := range mask {
+			mask[i] = 0xff
+		}
+	}
+
+	return odp.RawFlowKey{Type: typ, Key: key, Mask: mask}, nil
+}
+
+// Parse a raw action option, as printed by "flow list"
+func parseRawAction(opt string) (odp.RawAction, error) {
+	typ, rest, err := splitRawOption(opt)
+	if err != nil {
+		return odp.RawAction{}, err
+	}
+
+	data, err := hex.DecodeString(rest)
+	if err != nil {
+		return odp.RawAction{}, fmt.Errorf("invalid data in raw action \"%s\"", opt)
+	}
+
+	return odp.RawAction{Type: typ, Data: data}, nil
+}
+
 func handleEthernetFlowKeyOptions(flow odp.FlowSpec, src string, dst string) (err error) {
 	var k odp.OvsKeyEthernet
 	var m odp.OvsKeyEthernet
@@ -475,9 +859,9 @@ func handleEthernetAddrOption(opt string) (key [ETH_ALEN]byte, mask [ETH_ALEN]by
 }
 
 func addFlow(args []string, f Flags) bool {
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
@@ -488,21 +872,21 @@ func addFlow(args []string, f Flags) bool {
 
 	dp, err := dpif.LookupDatapath(args[0])
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	err = dp.CreateFlow(flow)
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	return true
 }
 
 func deleteFlow(args []string, f Flags) bool {
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
@@ -513,12 +897,12 @@ func deleteFlow(args []string, f Flags) bool {
 
 	dp, err := dpif.LookupDatapath(args[0])
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	err = dp.DeleteFlow(flow)
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	return true
@@ -529,20 +913,20 @@ func listFlows(args []string, f Flags) bool {
 		return false
 	}
 
-	dpif, err := odp.NewDpif()
+	dpif, err := newDpif()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 	defer dpif.Close()
 
 	dp, err := dpif.LookupDatapath(args[0])
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	flows, err := dp.EnumerateFlows()
 	if err != nil {
-		return printErr("%s", err)
+		return printOpErr(err)
 	}
 
 	for _, flow := range flows {
@@ -566,7 +950,7 @@ func printFlow(flow odp.FlowSpec, dp odp.DatapathHandle, dpname string) bool {
 		case odp.InPortFlowKey:
 			name, err := fk.VportHandle(dp).LookupName()
 			if err != nil {
-				return printErr("%s", err)
+				return printOpErr(err)
 			}
 
 			fmt.Printf(" --in-port=%s", name)
@@ -579,8 +963,14 @@ func printFlow(flow odp.FlowSpec, dp odp.DatapathHandle, dpname string) bool {
 			printEthAddrOption("eth-dst", k.EthDst, m.EthDst)
 			break
 
+		case odp.RawFlowKey:
+			fmt.Printf(" --raw-key=\"%d:%s&%s\"", fk.Type,
+				hex.EncodeToString(fk.Key),
+				hex.EncodeToString(fk.Mask))
+			break
+
 		default:
-			fmt.Printf("%v", fk)
+			fmt.Printf(" %v", fk)
 			break
 		}
 	}
@@ -592,7 +982,7 @@ func printFlow(flow odp.FlowSpec, dp odp.DatapathHandle, dpname string) bool {
 		case odp.OutputAction:
 			name, err := a.VportHandle(dp).LookupName()
 			if err != nil {
-				return printErr("%s", err)
+				return printOpErr(err)
 			}
 
 			outputs = append(outputs, name)
@@ -602,8 +992,25 @@ func printFlow(flow odp.FlowSpec, dp odp.DatapathHandle, dpname string) bool {
 			printSetTunnelAction(a)
 			break
 
+		case odp.MeterAction:
+			fmt.Printf(" --meter=%d", uint32(a))
+			break
+
+		case odp.RawAction:
+			fmt.Printf(" --raw-action=%d:%s", a.Type, hex.EncodeToString(a.Data))
+			break
+
+		case odp.ConntrackAction, odp.TruncateAction, odp.CloneAction, odp.CheckPktLenAction:
+			expr, err := formatAction(a, dp)
+			if err != nil {
+				return printOpErr(err)
+			}
+
+			fmt.Printf(" --action=\"%s\"", expr)
+			break
+
 		default:
-			fmt.Printf("%v", a)
+			fmt.Printf(" %v", a)
 			break
 		}
 	}
@@ -659,3 +1066,275 @@ func printSetTunnelAction(a odp.SetTunnelAction) {
 		fmt.Printf(" --set-tunnel-csum")
 	}
 }
+
+func parseMeterId(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, printErr("invalid meter id \"%s\"", s)
+	}
+
+	return uint32(id), true
+}
+
+func addMeter(args []string, f Flags) bool {
+	var rate, burst uint
+	var pps bool
+	f.UintVar(&rate, "rate", 0, "drop rate (kbps, or packets per second with --pps)")
+	f.UintVar(&burst, "burst", 0, "burst size (kb, or packets with --pps)")
+	f.BoolVar(&pps, "pps", false, "measure in packets rather than kilobits")
+	if !f.Parse() {
+		return false
+	}
+
+	id, ok := parseMeterId(args[1])
+	if !ok {
+		return false
+	}
+
+	if rate == 0 {
+		return printErr("--rate is required")
+	}
+
+	if rate > 0xffffffff || burst > 0xffffffff {
+		return printErr("rate or burst too large")
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.LookupDatapath(args[0])
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	err = dp.CreateMeter(odp.NewDropMeterSpec(id, !pps, uint32(rate), uint32(burst)))
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	return true
+}
+
+func deleteMeter(args []string, f Flags) bool {
+	if !f.Parse() {
+		return false
+	}
+
+	id, ok := parseMeterId(args[1])
+	if !ok {
+		return false
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.LookupDatapath(args[0])
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	err = dp.DeleteMeter(id)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	return true
+}
+
+func listMeters(args []string, f Flags) bool {
+	if !f.Parse() {
+		return false
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.LookupDatapath(args[0])
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	meters, err := dp.EnumerateMeters()
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	for _, m := range meters {
+		fmt.Printf("%d packets=%d bytes=%d", m.Id, m.NPackets, m.NBytes)
+		for i, band := range m.Bands {
+			fmt.Printf(" band%d:packets=%d,bytes=%d", i, band.NPackets, band.NBytes)
+		}
+		fmt.Printf("\n")
+	}
+
+	return true
+}
+
+func parseZoneId(s string) (int32, error) {
+	zone, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid conntrack zone \"%s\"", s)
+	}
+
+	return int32(zone), nil
+}
+
+func parseZoneIds(s string) ([]int32, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	res := make([]int32, 0)
+	for _, z := range strings.Split(s, ",") {
+		zone, err := parseZoneId(z)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, zone)
+	}
+
+	return res, nil
+}
+
+func setCtLimits(_ []string, f Flags) bool {
+	var defaultLimit int64
+	var zones string
+	f.Int64Var(&defaultLimit, "default", -1, "default connection limit (0 for unlimited)")
+	f.StringVar(&zones, "zones", "", "per-zone connection limits, as zone:limit,...")
+	if !f.Parse() {
+		return false
+	}
+
+	limits := make([]odp.OvsZoneLimit, 0)
+
+	if defaultLimit >= 0 {
+		if defaultLimit > 0xffffffff {
+			return printErr("default limit too large")
+		}
+
+		limits = append(limits, odp.OvsZoneLimit{
+			ZoneId: odp.OVS_ZONE_LIMIT_DEFAULT_ZONE,
+			Limit:  uint32(defaultLimit),
+		})
+	}
+
+	if zones != "" {
+		for _, zl := range strings.Split(zones, ",") {
+			i := strings.Index(zl, ":")
+			if i < 0 {
+				return printErr("invalid zone limit \"%s\"", zl)
+			}
+
+			zone, err := parseZoneId(zl[:i])
+			if err != nil {
+				return printOpErr(err)
+			}
+
+			limit, err := strconv.ParseUint(zl[i+1:], 10, 32)
+			if err != nil {
+				return printErr("invalid zone limit \"%s\"", zl)
+			}
+
+			limits = append(limits, odp.OvsZoneLimit{
+				ZoneId: zone,
+				Limit:  uint32(limit),
+			})
+		}
+	}
+
+	if len(limits) == 0 {
+		return printErr("No limits given")
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	err = dpif.SetConntrackLimits(limits)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	return true
+}
+
+func getCtLimits(_ []string, f Flags) bool {
+	var zones string
+	f.StringVar(&zones, "zones", "", "zones to show, as zone,... (default all)")
+	if !f.Parse() {
+		return false
+	}
+
+	zoneIds, err := parseZoneIds(zones)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	limits, err := dpif.GetConntrackLimits(zoneIds)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	for _, limit := range limits {
+		if limit.ZoneId == odp.OVS_ZONE_LIMIT_DEFAULT_ZONE {
+			fmt.Printf("default limit=%d\n", limit.Limit)
+		} else {
+			fmt.Printf("zone=%d limit=%d count=%d\n", limit.ZoneId, limit.Limit, limit.Count)
+		}
+	}
+
+	return true
+}
+
+func deleteCtLimits(_ []string, f Flags) bool {
+	var zones string
+	var defaultLimit bool
+	f.StringVar(&zones, "zones", "", "zones to remove limits from, as zone,...")
+	f.BoolVar(&defaultLimit, "default", false, "remove the default limit")
+	if !f.Parse() {
+		return false
+	}
+
+	zoneIds, err := parseZoneIds(zones)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	if defaultLimit {
+		zoneIds = append(zoneIds, odp.OVS_ZONE_LIMIT_DEFAULT_ZONE)
+	}
+
+	if len(zoneIds) == 0 {
+		return printErr("No zones given")
+	}
+
+	dpif, err := newDpif()
+	if err != nil {
+		return printOpErr(err)
+	}
+	defer dpif.Close()
+
+	err = dpif.DeleteConntrackLimits(zoneIds)
+	if err != nil {
+		return printOpErr(err)
+	}
+
+	return true
+}